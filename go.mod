@@ -1,3 +1,5 @@
 module hartomedia-studios/hartodb
 
 go 1.22.4
+
+require github.com/klauspost/compress v1.18.0
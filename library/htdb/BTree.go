@@ -0,0 +1,545 @@
+// BTree.go
+// Description: Persistent B+tree for the HTDB library
+// Stores fixed length keys together with a record ID and the record position in pages on disk
+// Author: harto.dev
+
+package htdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+const (
+	btreePageSize   = 4096
+	btreeMagic      = "HTBT"
+	btreeVersion    = 1
+	btreeHeaderSize = 7 // 1 byte node type, 2 bytes entry count, 4 bytes next leaf page
+
+	btreeLeaf     = 0
+	btreeInternal = 1
+)
+
+// btreeEntry is a single entry of the tree, entries are ordered by key and then by ID
+type btreeEntry struct {
+	key []byte
+	id  int64 // Record ID, makes duplicate keys unique
+	pos int64 // Position of the record in the table file (only used in leaves)
+}
+
+// btreeNode is a single page of the tree loaded into memory
+type btreeNode struct {
+	page     uint32
+	leaf     bool
+	entries  []btreeEntry // Leaf: entries, Internal: separators
+	children []uint32     // Internal only: len(entries)+1 child pages
+	next     uint32       // Leaf only: next leaf page, 0 if none
+}
+
+// btree is a B+tree stored in a single file
+// Page 0 holds the meta data, all other pages are nodes
+type btree struct {
+	file      *os.File
+	path      string
+	keyLen    int
+	root      uint32
+	pageCount uint32
+	count     uint64
+	mu        sync.RWMutex
+}
+
+// btreeMaxKeyLength is the longest key a tree can hold while still fitting enough entries into a page
+const btreeMaxKeyLength = 1024
+
+// openBTree opens the tree at path, the file is created if it doesn't exist
+func openBTree(path string, keyLen int) (*btree, error) {
+	if keyLen <= 0 || keyLen > btreeMaxKeyLength {
+		return nil, fmt.Errorf("index key length must be between 1 and %d bytes", btreeMaxKeyLength)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index file: %v", err)
+	}
+
+	t := &btree{
+		file:   file,
+		path:   path,
+		keyLen: keyLen,
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get index file stats: %v", err)
+	}
+
+	// New file, write the meta page and an empty root leaf
+	if stat.Size() == 0 {
+		t.pageCount = 1
+		root := &btreeNode{page: t.allocPage(), leaf: true}
+		t.root = root.page
+		if err := t.writeNode(root); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := t.writeMeta(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return t, nil
+	}
+
+	if err := t.readMeta(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Close closes the tree file
+func (t *btree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.file.Close()
+}
+
+// Sync flushes the tree file to disk
+func (t *btree) Sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.file.Sync()
+}
+
+// Len returns the number of entries in the tree
+func (t *btree) Len() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.count
+}
+
+// Insert inserts an entry, an existing entry with the same key and ID gets its position replaced
+func (t *btree) Insert(key []byte, id, pos int64) error {
+	if len(key) != t.keyLen {
+		return fmt.Errorf("index key has %d bytes, expected %d", len(key), t.keyLen)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := btreeEntry{key: key, id: id, pos: pos}
+	split, sep, right, err := t.insert(t.root, entry)
+	if err != nil {
+		return err
+	}
+
+	// The root was split, grow the tree by one level
+	if split {
+		root := &btreeNode{
+			page:     t.allocPage(),
+			leaf:     false,
+			entries:  []btreeEntry{sep},
+			children: []uint32{t.root, right},
+		}
+		if err := t.writeNode(root); err != nil {
+			return err
+		}
+		t.root = root.page
+	}
+
+	return t.writeMeta()
+}
+
+// Delete removes the entry with the given key and ID, it returns false if there was no such entry
+// Nodes are not merged when they get underfull, empty leaves simply stay in the leaf chain
+func (t *btree) Delete(key []byte, id int64) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := btreeEntry{key: key, id: id}
+	leaf, err := t.findLeaf(entry)
+	if err != nil {
+		return false, err
+	}
+
+	i, found := leaf.search(entry)
+	if !found {
+		return false, nil
+	}
+
+	leaf.entries = append(leaf.entries[:i], leaf.entries[i+1:]...)
+	if err := t.writeNode(leaf); err != nil {
+		return false, err
+	}
+
+	t.count--
+	return true, t.writeMeta()
+}
+
+// Range calls fn for every entry with lo <= key <= hi in order, a nil bound is unbounded
+// If an inclusive flag is false the bound itself is excluded, fn can stop the iteration by returning false
+func (t *btree) Range(lo, hi []byte, loInclusive, hiInclusive bool, fn func(key []byte, id, pos int64) bool) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// Find the first leaf that can hold lo
+	var leaf *btreeNode
+	var err error
+	if lo == nil {
+		leaf, err = t.leftmostLeaf()
+	} else {
+		leaf, err = t.findLeaf(btreeEntry{key: lo, id: math.MinInt64})
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		for _, e := range leaf.entries {
+			if lo != nil {
+				cmp := bytes.Compare(e.key, lo)
+				if cmp < 0 || (cmp == 0 && !loInclusive) {
+					continue
+				}
+			}
+			if hi != nil {
+				cmp := bytes.Compare(e.key, hi)
+				if cmp > 0 || (cmp == 0 && !hiInclusive) {
+					return nil
+				}
+			}
+			if !fn(e.key, e.id, e.pos) {
+				return nil
+			}
+		}
+
+		if leaf.next == 0 {
+			return nil
+		}
+		leaf, err = t.readNode(leaf.next)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// insert inserts an entry into the subtree at page and reports if the node was split
+func (t *btree) insert(page uint32, e btreeEntry) (bool, btreeEntry, uint32, error) {
+	node, err := t.readNode(page)
+	if err != nil {
+		return false, btreeEntry{}, 0, err
+	}
+
+	if node.leaf {
+		i, found := node.search(e)
+		if found {
+			node.entries[i].pos = e.pos
+			return false, btreeEntry{}, 0, t.writeNode(node)
+		}
+
+		node.entries = append(node.entries, btreeEntry{})
+		copy(node.entries[i+1:], node.entries[i:])
+		node.entries[i] = e
+		t.count++
+
+		if len(node.entries) <= t.maxLeafEntries() {
+			return false, btreeEntry{}, 0, t.writeNode(node)
+		}
+
+		// Split the leaf, the first entry of the right node becomes the separator
+		mid := len(node.entries) / 2
+		right := &btreeNode{
+			page:    t.allocPage(),
+			leaf:    true,
+			entries: append([]btreeEntry{}, node.entries[mid:]...),
+			next:    node.next,
+		}
+		node.entries = node.entries[:mid]
+		node.next = right.page
+
+		if err := t.writeNode(right); err != nil {
+			return false, btreeEntry{}, 0, err
+		}
+		if err := t.writeNode(node); err != nil {
+			return false, btreeEntry{}, 0, err
+		}
+
+		sep := right.entries[0]
+		return true, btreeEntry{key: sep.key, id: sep.id}, right.page, nil
+	}
+
+	// Internal node, find the child that covers the entry
+	i := node.childIndex(e)
+	split, sep, rightChild, err := t.insert(node.children[i], e)
+	if err != nil || !split {
+		return false, btreeEntry{}, 0, err
+	}
+
+	node.entries = append(node.entries, btreeEntry{})
+	copy(node.entries[i+1:], node.entries[i:])
+	node.entries[i] = sep
+
+	node.children = append(node.children, 0)
+	copy(node.children[i+2:], node.children[i+1:])
+	node.children[i+1] = rightChild
+
+	if len(node.entries) <= t.maxInternalEntries() {
+		return false, btreeEntry{}, 0, t.writeNode(node)
+	}
+
+	// Split the internal node, the middle separator moves up
+	mid := len(node.entries) / 2
+	promoted := node.entries[mid]
+	right := &btreeNode{
+		page:     t.allocPage(),
+		leaf:     false,
+		entries:  append([]btreeEntry{}, node.entries[mid+1:]...),
+		children: append([]uint32{}, node.children[mid+1:]...),
+	}
+	node.entries = node.entries[:mid]
+	node.children = node.children[:mid+1]
+
+	if err := t.writeNode(right); err != nil {
+		return false, btreeEntry{}, 0, err
+	}
+	if err := t.writeNode(node); err != nil {
+		return false, btreeEntry{}, 0, err
+	}
+
+	return true, promoted, right.page, nil
+}
+
+// findLeaf returns the leaf that covers the entry
+func (t *btree) findLeaf(e btreeEntry) (*btreeNode, error) {
+	node, err := t.readNode(t.root)
+	if err != nil {
+		return nil, err
+	}
+
+	for !node.leaf {
+		node, err = t.readNode(node.children[node.childIndex(e)])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// leftmostLeaf returns the first leaf of the leaf chain
+func (t *btree) leftmostLeaf() (*btreeNode, error) {
+	node, err := t.readNode(t.root)
+	if err != nil {
+		return nil, err
+	}
+
+	for !node.leaf {
+		node, err = t.readNode(node.children[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// search returns the position of the first entry >= e and if it is equal to e
+func (n *btreeNode) search(e btreeEntry) (int, bool) {
+	lo, hi := 0, len(n.entries)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if compareEntries(n.entries[mid], e) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, lo < len(n.entries) && compareEntries(n.entries[lo], e) == 0
+}
+
+// childIndex returns the index of the child that covers the entry
+// Separators are the first entry of their right subtree
+func (n *btreeNode) childIndex(e btreeEntry) int {
+	lo, hi := 0, len(n.entries)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if compareEntries(n.entries[mid], e) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// compareEntries orders entries by key and then by ID
+func compareEntries(a, b btreeEntry) int {
+	if cmp := bytes.Compare(a.key, b.key); cmp != 0 {
+		return cmp
+	}
+	switch {
+	case a.id < b.id:
+		return -1
+	case a.id > b.id:
+		return 1
+	}
+	return 0
+}
+
+// maxLeafEntries returns how many entries fit into a leaf page
+func (t *btree) maxLeafEntries() int {
+	return (btreePageSize - btreeHeaderSize) / (t.keyLen + 16)
+}
+
+// maxInternalEntries returns how many separators fit into an internal page
+func (t *btree) maxInternalEntries() int {
+	return (btreePageSize - btreeHeaderSize - 4) / (t.keyLen + 12)
+}
+
+// allocPage reserves a new page at the end of the file
+func (t *btree) allocPage() uint32 {
+	page := t.pageCount
+	t.pageCount++
+	return page
+}
+
+// readMeta reads the meta page
+func (t *btree) readMeta() error {
+	data := make([]byte, btreePageSize)
+	if _, err := t.file.ReadAt(data, 0); err != nil {
+		return fmt.Errorf("failed to read index meta page: %v", err)
+	}
+
+	if string(data[0:4]) != btreeMagic {
+		return fmt.Errorf("file is not an index file")
+	}
+	if binary.LittleEndian.Uint16(data[4:6]) != btreeVersion {
+		return fmt.Errorf("unsupported index version %d", binary.LittleEndian.Uint16(data[4:6]))
+	}
+	if int(binary.LittleEndian.Uint16(data[6:8])) != t.keyLen {
+		return fmt.Errorf("index key length %d doesn't match field length %d", binary.LittleEndian.Uint16(data[6:8]), t.keyLen)
+	}
+
+	t.root = binary.LittleEndian.Uint32(data[8:12])
+	t.pageCount = binary.LittleEndian.Uint32(data[12:16])
+	t.count = binary.LittleEndian.Uint64(data[16:24])
+	return nil
+}
+
+// writeMeta writes the meta page
+func (t *btree) writeMeta() error {
+	data := make([]byte, btreePageSize)
+	copy(data[0:4], btreeMagic)
+	binary.LittleEndian.PutUint16(data[4:6], btreeVersion)
+	binary.LittleEndian.PutUint16(data[6:8], uint16(t.keyLen))
+	binary.LittleEndian.PutUint32(data[8:12], t.root)
+	binary.LittleEndian.PutUint32(data[12:16], t.pageCount)
+	binary.LittleEndian.PutUint64(data[16:24], t.count)
+
+	if _, err := t.file.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("failed to write index meta page: %v", err)
+	}
+	return nil
+}
+
+// readNode reads a node page
+func (t *btree) readNode(page uint32) (*btreeNode, error) {
+	if page == 0 || page >= t.pageCount {
+		return nil, fmt.Errorf("invalid index page %d", page)
+	}
+
+	data := make([]byte, btreePageSize)
+	if _, err := t.file.ReadAt(data, int64(page)*btreePageSize); err != nil {
+		return nil, fmt.Errorf("failed to read index page %d: %v", page, err)
+	}
+
+	node := &btreeNode{
+		page: page,
+		leaf: data[0] == btreeLeaf,
+		next: binary.LittleEndian.Uint32(data[3:7]),
+	}
+	n := int(binary.LittleEndian.Uint16(data[1:3]))
+	offset := btreeHeaderSize
+
+	if node.leaf {
+		node.entries = make([]btreeEntry, n)
+		for i := 0; i < n; i++ {
+			key := make([]byte, t.keyLen)
+			copy(key, data[offset:offset+t.keyLen])
+			offset += t.keyLen
+			node.entries[i] = btreeEntry{
+				key: key,
+				id:  int64(binary.LittleEndian.Uint64(data[offset : offset+8])),
+				pos: int64(binary.LittleEndian.Uint64(data[offset+8 : offset+16])),
+			}
+			offset += 16
+		}
+		return node, nil
+	}
+
+	node.entries = make([]btreeEntry, n)
+	node.children = make([]uint32, n+1)
+	node.children[0] = binary.LittleEndian.Uint32(data[offset : offset+4])
+	offset += 4
+	for i := 0; i < n; i++ {
+		key := make([]byte, t.keyLen)
+		copy(key, data[offset:offset+t.keyLen])
+		offset += t.keyLen
+		node.entries[i] = btreeEntry{
+			key: key,
+			id:  int64(binary.LittleEndian.Uint64(data[offset : offset+8])),
+		}
+		offset += 8
+		node.children[i+1] = binary.LittleEndian.Uint32(data[offset : offset+4])
+		offset += 4
+	}
+
+	return node, nil
+}
+
+// writeNode writes a node to its page
+func (t *btree) writeNode(node *btreeNode) error {
+	data := make([]byte, btreePageSize)
+	if node.leaf {
+		data[0] = btreeLeaf
+	} else {
+		data[0] = btreeInternal
+	}
+	binary.LittleEndian.PutUint16(data[1:3], uint16(len(node.entries)))
+	binary.LittleEndian.PutUint32(data[3:7], node.next)
+	offset := btreeHeaderSize
+
+	if node.leaf {
+		for _, e := range node.entries {
+			copy(data[offset:offset+t.keyLen], e.key)
+			offset += t.keyLen
+			binary.LittleEndian.PutUint64(data[offset:offset+8], uint64(e.id))
+			binary.LittleEndian.PutUint64(data[offset+8:offset+16], uint64(e.pos))
+			offset += 16
+		}
+	} else {
+		binary.LittleEndian.PutUint32(data[offset:offset+4], node.children[0])
+		offset += 4
+		for i, e := range node.entries {
+			copy(data[offset:offset+t.keyLen], e.key)
+			offset += t.keyLen
+			binary.LittleEndian.PutUint64(data[offset:offset+8], uint64(e.id))
+			offset += 8
+			binary.LittleEndian.PutUint32(data[offset:offset+4], node.children[i+1])
+			offset += 4
+		}
+	}
+
+	if _, err := t.file.WriteAt(data, int64(node.page)*btreePageSize); err != nil {
+		return fmt.Errorf("failed to write index page %d: %v", node.page, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package htdb
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+func TestBTreeKeepsEntriesInOrderAcrossSplits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree.htdb")
+	tree, err := openBTree(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough entries to split many leaves, inserted out of order
+	const n = 5000
+	key := func(i int) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, uint64(i))
+		return k
+	}
+	for i := 0; i < n; i++ {
+		v := (i * 7919) % n
+		if err := tree.Insert(key(v), int64(v), int64(v)*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		if found, err := tree.Delete(key(i), int64(i)); err != nil || !found {
+			t.Fatalf("failed to delete entry %d: %v", i, err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = openBTree(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if tree.Len() != n/2 {
+		t.Fatalf("tree has %d entries after reopening, want %d", tree.Len(), n/2)
+	}
+
+	next := 1001
+	err = tree.Range(key(1000), key(3000), false, true, func(k []byte, id, pos int64) bool {
+		if id != int64(next) || pos != int64(next)*10 {
+			t.Fatalf("range returned entry %d at %d, want %d", id, pos, next)
+		}
+		next += 2
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 3001 {
+		t.Fatalf("range stopped before entry %d", next)
+	}
+}
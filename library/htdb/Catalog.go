@@ -0,0 +1,225 @@
+// Catalog.go
+// Description: Schema catalog for the HTDB library
+// The index.conf.htdb file of a schema lists its tables with their fields, indexes and format versions.
+// It is the only place table configurations are stored and is replaced as a whole on every change
+// Author: harto.dev
+
+package htdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const catalogFileName = "index.conf" + fileEnding
+
+// catalogFormatVersion is the layout of the catalog file
+const catalogFormatVersion = 1
+
+// schemaCatalog is the content of the catalog file of a schema
+type schemaCatalog struct {
+	FormatVersion int               `json:"formatVersion"`
+	Tables        map[string]*Table `json:"tables"`
+}
+
+// catalogMu serializes changes of catalog files, so two changes of the same schema never overwrite each other
+var catalogMu sync.Mutex
+
+// catalogPath returns the path of the catalog file of a schema directory
+func catalogPath(schemaPath string) string {
+	return filepath.Join(schemaPath, catalogFileName)
+}
+
+// newCatalog returns an empty catalog
+func newCatalog() *schemaCatalog {
+	return &schemaCatalog{
+		FormatVersion: catalogFormatVersion,
+		Tables:        make(map[string]*Table),
+	}
+}
+
+// readCatalog reads the catalog of a schema directory
+// Catalogs of older versions of the library are empty files, they are returned with format version 0
+func readCatalog(schemaPath string) (*schemaCatalog, error) {
+	data, err := os.ReadFile(catalogPath(schemaPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema catalog: %v", err)
+	}
+
+	catalog := newCatalog()
+	if len(data) == 0 {
+		catalog.FormatVersion = 0
+		return catalog, nil
+	}
+
+	err = json.Unmarshal(data, catalog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema catalog: %v", err)
+	}
+	if catalog.Tables == nil {
+		catalog.Tables = make(map[string]*Table)
+	}
+
+	return catalog, nil
+}
+
+// writeCatalog replaces the catalog of a schema directory
+// The catalog is written to a temporary file first, so it is never half written
+func writeCatalog(schemaPath string, catalog *schemaCatalog) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize schema catalog: %v", err)
+	}
+
+	path := catalogPath(schemaPath)
+	tempPath := path + ".temp"
+	err = os.WriteFile(tempPath, data, 0644)
+	if err == nil {
+		err = syncFile(tempPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write schema catalog: %v", err)
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return fmt.Errorf("failed to replace schema catalog: %v", err)
+	}
+	syncDir(schemaPath)
+
+	return nil
+}
+
+// updateCatalog reads the catalog of a schema directory, changes it with fn and writes it back
+// Nothing is written if fn returns an error
+func updateCatalog(schemaPath string, fn func(catalog *schemaCatalog) error) error {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	catalog, err := readCatalog(schemaPath)
+	if err != nil {
+		return err
+	}
+
+	err = fn(catalog)
+	if err != nil {
+		return err
+	}
+
+	catalog.FormatVersion = catalogFormatVersion
+	return writeCatalog(schemaPath, catalog)
+}
+
+// catalogTables returns the sorted table names of a catalog
+func (c *schemaCatalog) tableNames() []string {
+	names := make([]string, 0, len(c.Tables))
+	for name := range c.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// upgradeCatalogs fills the catalogs of schemas written by older versions of the library
+// with the configuration files of their tables, the configuration files are removed afterwards
+func (db *HTDB) upgradeCatalogs() error {
+	schemas, err := db.ListSchemas()
+	if err != nil {
+		return err
+	}
+
+	for _, schema := range schemas {
+		schemaPath := filepath.Join(db.mainPath, schema)
+
+		// Schemas without a catalog file get an empty one
+		if _, err := os.Stat(catalogPath(schemaPath)); os.IsNotExist(err) {
+			err = os.WriteFile(catalogPath(schemaPath), nil, 0644)
+			if err != nil {
+				return NewResponse(StatusDbError, fmt.Sprint(err))
+			}
+		}
+
+		catalog, err := readCatalog(schemaPath)
+		if err != nil {
+			return err
+		}
+
+		confPaths, err := legacyConfPaths(schemaPath)
+		if err != nil {
+			return err
+		}
+
+		if catalog.FormatVersion == 0 {
+			for _, path := range confPaths {
+				table, err := readLegacyConf(path)
+				if err != nil {
+					return err
+				}
+				table.SchemaPath = schemaPath
+				catalog.Tables[table.TableName] = table
+			}
+
+			catalog.FormatVersion = catalogFormatVersion
+			err = writeCatalog(schemaPath, catalog)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The catalog is written, the old configuration files are not used anymore
+		for _, path := range confPaths {
+			os.Remove(path)
+		}
+		syncDir(schemaPath)
+	}
+
+	return nil
+}
+
+// legacyConfPaths returns the table configuration files older versions of the library wrote next to the tables
+func legacyConfPaths(schemaPath string) ([]string, error) {
+	entries, err := os.ReadDir(schemaPath)
+	if err != nil {
+		return nil, NewResponse(StatusDbError, fmt.Sprint(err))
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".conf"+fileEnding) || name == catalogFileName {
+			continue
+		}
+		paths = append(paths, filepath.Join(schemaPath, name))
+	}
+
+	return paths, nil
+}
+
+// readLegacyConf reads a table configuration file, the creation time is taken from the file
+func readLegacyConf(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table configuration: %v", err)
+	}
+
+	var table Table
+	err = json.Unmarshal(data, &table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse table configuration %s: %v", filepath.Base(path), err)
+	}
+
+	if table.TableName == "" {
+		table.TableName = strings.TrimSuffix(filepath.Base(path), ".conf"+fileEnding)
+	}
+	if stat, err := os.Stat(path); err == nil && table.CreatedAt.IsZero() {
+		table.CreatedAt = stat.ModTime()
+	}
+
+	return &table, nil
+}
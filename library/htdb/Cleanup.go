@@ -1,16 +1,15 @@
 // Cleanup.go
 // Description: Background cleanup worker for the HTDB library
 // Implements periodic cleanup of outdated and deleted records
+// A table file is compacted together with its ref files, the new files are switched to in one step
 // Author: harto.dev
 
 package htdb
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 )
@@ -111,135 +110,149 @@ func (w *CleanupWorker) performCleanup() {
 
 // getSchemas returns all schemas in the database
 func (w *CleanupWorker) getSchemas() ([]string, error) {
-	// Get all directories in the main path
-	entries, err := os.ReadDir(w.db.mainPath)
+	schemas, err := w.db.ListSchemas()
 	if err != nil {
 		return nil, fmt.Errorf("failed to read main directory: %v", err)
 	}
 
-	var schemas []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			schemas = append(schemas, entry.Name())
-		}
-	}
-
 	return schemas, nil
 }
 
 // getTables returns all tables in a schema
 func (w *CleanupWorker) getTables(schema string) ([]string, error) {
-	schemaPath := filepath.Join(w.db.mainPath, schema)
-
-	// Get all files in the schema directory
-	entries, err := os.ReadDir(schemaPath)
+	tables, err := listTables(filepath.Join(w.db.mainPath, schema))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read schema directory: %v", err)
 	}
 
-	var tables []string
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			name := entry.Name()
-			// Check if it's a table file (not a config or data file)
-			if filepath.Ext(name) == fileEnding &&
-				!strings.HasSuffix(name, ".conf"+fileEnding) &&
-				!strings.HasSuffix(name, ".data"+fileEnding) {
-				// Remove the extension
-				tableName := name[:len(name)-len(fileEnding)]
-				tables = append(tables, tableName)
-			}
-		}
-	}
-
 	return tables, nil
 }
 
 // cleanupTable cleans up a table by removing outdated and deleted records
+// Versions that were replaced or deleted within the history retention window are kept
+// Tables that a transaction uses are skipped, they are cleaned up in a later run
 func (w *CleanupWorker) cleanupTable(schema, tableName string) error {
 	// Get the table
-	tableConfPath := filepath.Join(w.db.mainPath, schema, tableName+".conf"+fileEnding)
-	tableDataPath := filepath.Join(w.db.mainPath, schema, tableName+fileEnding)
+	table, err := GetTable(schema+":"+tableName, w.db.mainPath)
+	if err != nil {
+		return fmt.Errorf("failed to get table: %v", err)
+	}
 
-	// Read the table configuration
-	tableConf, err := os.ReadFile(tableConfPath)
+	// The files are rewritten, so no transaction may use the table and no commit may run at the same time
+	release, err := w.db.reserveTables(table)
+	if response, ok := err.(Response); ok && response.StatusCode == StatusTableBusy {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read table configuration: %v", err)
+		return err
 	}
+	defer release()
 
-	var table Table
-	err = json.Unmarshal(tableConf, &table)
+	// The configuration might have changed before the table was reserved
+	table, err = GetTable(schema+":"+tableName, w.db.mainPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse table configuration: %v", err)
+		return fmt.Errorf("failed to get table: %v", err)
 	}
 
-	// Set the schema path
-	table.SchemaPath = filepath.Join(w.db.mainPath, schema)
+	// The files of the generation before the last compaction are removed once no reader uses them anymore
+	// Until then the table is not compacted again, so the files are removed by a later run
+	tm := w.db.GetTableManager()
+	if table.Generation > 0 {
+		if tm.generationInUse(table, table.Generation-1) {
+			return nil
+		}
+		tm.removeGeneration(table, table.Generation-1)
+	}
 
 	// Read all records from the table
-	records, err := table.GetAllRecords()
+	records, err := table.readAllRecords()
 	if err != nil {
 		return fmt.Errorf("failed to read records: %v", err)
 	}
 
-	// Filter out outdated and deleted records
-	var currentRecords []*Record
-	for _, record := range records {
-		if record.Metadata.IsCurrent && !record.Metadata.IsDeleted {
-			currentRecords = append(currentRecords, record)
-		}
+	// Filter out outdated and deleted records, open transactions still read the versions of their snapshot
+	// Commits wait for the reservation, so transactions that begin from here on can't see a dropped version
+	horizon := time.Now().Add(-tm.HistoryRetention()).UnixNano()
+	if oldest, exists := tm.oldestSnapshot(); exists && oldest < horizon {
+		horizon = oldest
 	}
+	currentRecords := retainedVersions(records, horizon)
 
 	// If no records were filtered out, no cleanup needed
 	if len(currentRecords) == len(records) {
 		return nil
 	}
 
-	// Create a temporary file for the new table data
-	tempDataPath := tableDataPath + ".temp"
-	tempFile, err := os.Create(tempDataPath)
-	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %v", err)
-	}
-	defer tempFile.Close()
-
-	// Write current records to the temporary file
+	// The dropped versions no longer refer to their dedup values
+	kept := make(map[*Record]bool)
 	for _, record := range currentRecords {
-		data, err := record.Serialize(table.Fields)
-		if err != nil {
-			return fmt.Errorf("failed to serialize record: %v", err)
-		}
-		_, err = tempFile.Write(data)
-		if err != nil {
-			return fmt.Errorf("failed to write record to temporary file: %v", err)
+		kept[record] = true
+	}
+	var dropped []*Record
+	for _, record := range records {
+		if !kept[record] {
+			dropped = append(dropped, record)
 		}
 	}
 
-	// Close the temporary file
-	tempFile.Close()
+	return tm.compactTable(table, currentRecords, dropped)
+}
 
-	// Replace the old file with the new one
-	err = os.Rename(tempDataPath, tableDataPath)
-	if err != nil {
-		return fmt.Errorf("failed to replace table file: %v", err)
-	}
+// compactTable writes the given records and the ref values they use to the files of the next generation of a table
+// Storing the new generation in the catalog switches over to the new files in one step. The files of the old
+// generation stay for readers that started before, the next cleanup run removes them. The caller has reserved the table
+func (tm *TableManager) compactTable(table *Table, records, dropped []*Record) error {
+	next := *table
+	next.Generation++
 
-	// Clean up ref field files
+	// The table is reserved, so no transaction appends values to its ref files while they are copied
+	// Ref values move, the records get their new offsets before the table file is written
 	for _, field := range table.Fields {
-		if field.Type == "ref" {
-			err := w.cleanupRefField(schema, tableName, field.Name, currentRecords)
+		if isRefField(field) {
+			err := stageRefField(table, &next, field, records, dropped)
 			if err != nil {
-				fmt.Printf("Error cleaning up ref field %s: %v\n", field.Name, err)
+				tm.removeGeneration(table, next.Generation)
+				return fmt.Errorf("failed to compact ref field '%s': %v", field.Name, err)
 			}
 		}
 	}
 
+	err := writeRecordsFile(next.dataPath(), next.Fields, records)
+	if err != nil {
+		tm.removeGeneration(table, next.Generation)
+		return err
+	}
+
+	// Record positions changed, the indexes of the new generation are built before it is used
+	for _, name := range next.Indexes {
+		field, exists := next.getField(name)
+		if !exists {
+			continue
+		}
+		_, err := tm.openIndex(&next, field)
+		if err != nil {
+			tm.removeGeneration(table, next.Generation)
+			return fmt.Errorf("failed to build index on '%s': %v", name, err)
+		}
+	}
+	syncDir(table.SchemaPath)
+
+	err = next.saveConfig()
+	if err != nil {
+		tm.removeGeneration(table, next.Generation)
+		return fmt.Errorf("failed to switch to the compacted files: %v", err)
+	}
+
+	tm.setGeneration(&next)
 	return nil
 }
 
-// cleanupRefField cleans up a ref field file by removing unused data
-func (w *CleanupWorker) cleanupRefField(schema, tableName, fieldName string, records []*Record) error {
-	refFilePath := filepath.Join(w.db.mainPath, schema, tableName+"."+fieldName+".data"+fileEnding)
+// stageRefField writes the values of a ref field that the records refer to into the data file of the next generation
+// Values that several records share are kept once, the records get the offsets in the new file
+// Values of dedup fields are kept while their reference count without the dropped versions is above 0
+// Offsets outside of the data file abort the compaction, the files of the table are left as they are
+func stageRefField(table, next *Table, field Field, records, dropped []*Record) error {
+	refFilePath := table.refPath(field.Name)
 
 	// Check if the ref file exists
 	if _, err := os.Stat(refFilePath); os.IsNotExist(err) {
@@ -252,76 +265,251 @@ func (w *CleanupWorker) cleanupRefField(schema, tableName, fieldName string, rec
 		return fmt.Errorf("failed to read ref field file: %v", err)
 	}
 
-	// Create a map of used offsets
-	usedRanges := make(map[[2]int64]bool)
+	// Reference counts of the values that are left when the dropped versions are gone
+	var state *refFileState
+	counts := make(map[*refContentEntry]int64)
+	if field.Dedup {
+		state = refState(refFilePath)
+		state.mu.Lock()
+		defer state.mu.Unlock()
+
+		err := state.load(refFilePath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range state.stored {
+			counts[entry] = entry.count
+		}
+		for _, record := range dropped {
+			offsets, exists := record.RefOffsets[field.Name]
+			if !exists {
+				continue
+			}
+			if entry, exists := state.stored[offsets]; exists {
+				counts[entry]--
+			}
+		}
+	}
+
+	// Create a map to track new offsets
+	offsetMap := make(map[[2]int64][2]int64)
+	var compacted, hashes []byte
+
+	// copyValue appends a value to the new data file and returns its new offsets
+	copyValue := func(offsets [2]int64) [2]int64 {
+		newOffsets := [2]int64{int64(len(compacted)), int64(len(compacted)) + offsets[1] - offsets[0]}
+		compacted = append(compacted, refData[offsets[0]:offsets[1]]...)
+		offsetMap[offsets] = newOffsets
+		if field.Dedup {
+			entry := state.stored[offsets]
+			hashes = append(hashes, encodeRefHash(&refContentEntry{hash: entry.hash, offsets: newOffsets, count: counts[entry]})...)
+		}
+		return newOffsets
+	}
+
+	// Copy the used data and update offsets
 	for _, record := range records {
-		if offsets, exists := record.RefOffsets[fieldName]; exists {
-			usedRanges[offsets] = true
+		offsets, exists := record.RefOffsets[field.Name]
+		if !exists {
+			continue
+		}
+
+		// Check if we've already processed this range
+		if newOffsets, processed := offsetMap[offsets]; processed {
+			record.RefOffsets[field.Name] = newOffsets
+			continue
+		}
+
+		// A value that is not in the file can't be copied, the record would point at some other value afterwards
+		start, end := offsets[0], offsets[1]
+		if start < 0 || end > int64(len(refData)) || start > end {
+			return fmt.Errorf("record %d has invalid offsets %d-%d", record.ID, start, end)
+		}
+
+		// A kept version that is not counted would lose its value in a later compaction
+		if field.Dedup {
+			if entry, exists := state.stored[offsets]; !exists || counts[entry] <= 0 {
+				return fmt.Errorf("record %d refers to the value at %d-%d, which has no references counted", record.ID, start, end)
+			}
 		}
+
+		record.RefOffsets[field.Name] = copyValue(offsets)
 	}
 
-	// If all offsets are used, no cleanup needed
-	if len(usedRanges) == 0 {
-		return nil
+	// Counts that are too high after a crash keep their values, in hash file order
+	if field.Dedup {
+		for _, entry := range state.entries {
+			offsets := entry.offsets
+			if state.stored[offsets] != entry || counts[entry] <= 0 {
+				continue
+			}
+			if _, processed := offsetMap[offsets]; processed {
+				continue
+			}
+			if offsets[0] < 0 || offsets[1] > int64(len(refData)) || offsets[0] > offsets[1] {
+				continue
+			}
+			copyValue(offsets)
+		}
 	}
 
-	// Create a temporary file for the new ref data
-	tempRefPath := refFilePath + ".temp"
-	tempFile, err := os.Create(tempRefPath)
+	err = writeSyncedFile(next.refPath(field.Name), compacted)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary ref file: %v", err)
+		return fmt.Errorf("failed to write ref field file: %v", err)
 	}
-	defer tempFile.Close()
 
-	// Create a map to track new offsets
-	offsetMap := make(map[[2]int64][2]int64)
-	currentOffset := int64(0)
+	// The hash file lists the values that are left at their new offsets with their counts
+	if field.Dedup {
+		err = writeSyncedFile(refHashPath(next.refPath(field.Name)), hashes)
+		if err != nil {
+			return fmt.Errorf("failed to write ref hash file: %v", err)
+		}
+	}
 
-	// Write used data to the temporary file and update offsets
-	for _, record := range records {
-		if offsets, exists := record.RefOffsets[fieldName]; exists {
-			// Check if we've already processed this range
-			if newOffsets, processed := offsetMap[offsets]; processed {
-				record.RefOffsets[fieldName] = newOffsets
-				continue
-			}
+	return nil
+}
 
-			// Extract the data
-			start, end := offsets[0], offsets[1]
-			if start < 0 || end > int64(len(refData)) || start > end {
-				continue // Skip invalid offsets
-			}
+// removeGeneration removes the files a table has in a generation and forgets what was read from them
+func (tm *TableManager) removeGeneration(table *Table, generation int) {
+	old := tm.forgetFiles(table, generation)
+	for _, path := range old.generationFiles() {
+		os.Remove(path)
+	}
+}
 
-			data := refData[start:end]
+// forgetFiles closes the indexes a table has in a generation and forgets what was read from its files
+// It returns a handle of the table in that generation
+func (tm *TableManager) forgetFiles(table *Table, generation int) *Table {
+	old := *table
+	old.Generation = generation
 
-			// Write to the temporary file
-			newStart := currentOffset
-			_, err := tempFile.Write(data)
-			if err != nil {
-				return fmt.Errorf("failed to write ref data to temporary file: %v", err)
-			}
+	for _, field := range old.Fields {
+		tm.closeIndex(&old, field.Name)
+		if isRefField(field) {
+			forgetRefContent(old.refPath(field.Name))
+		}
+	}
+	tm.dropVersions(&old)
+
+	return &old
+}
+
+// setGeneration makes handles of a table that were loaded before a compaction read the files of the new generation
+func (tm *TableManager) setGeneration(table *Table) {
+	tm.generationsMu.Lock()
+	defer tm.generationsMu.Unlock()
+
+	tm.generations[table.ID()] = table.Generation
+}
 
-			newEnd := newStart + int64(len(data))
+// current returns a handle of the table that reads the files of its current generation
+// Handles loaded before a compaction name the old files, readers use the returned handle for all files they read
+func (tm *TableManager) current(table *Table) *Table {
+	tm.generationsMu.Lock()
+	generation, compacted := tm.generations[table.ID()]
+	tm.generationsMu.Unlock()
 
-			// Update the record's offsets
-			newOffsets := [2]int64{newStart, newEnd}
-			record.RefOffsets[fieldName] = newOffsets
+	if !compacted || generation <= table.Generation {
+		return table
+	}
+
+	current := *table
+	current.Generation = generation
+	return &current
+}
+
+// tableGeneration names the files a table has in one generation
+type tableGeneration struct {
+	table      TableID
+	generation int
+}
+
+// pin returns a handle of the table that reads the files of its current generation, like current
+// The files of that generation are not removed by the cleanup until the returned function is called
+func (tm *TableManager) pin(table *Table) (*Table, func()) {
+	tm.generationsMu.Lock()
+	key := tableGeneration{table: table.ID(), generation: table.Generation}
+	if generation, compacted := tm.generations[table.ID()]; compacted && generation > key.generation {
+		key.generation = generation
+	}
+	tm.readers[key]++
+	tm.generationsMu.Unlock()
 
-			// Store the mapping for other records that might use the same range
-			offsetMap[offsets] = newOffsets
+	release := func() {
+		tm.generationsMu.Lock()
+		defer tm.generationsMu.Unlock()
 
-			currentOffset = newEnd
+		tm.readers[key]--
+		if tm.readers[key] == 0 {
+			delete(tm.readers, key)
 		}
 	}
 
-	// Close the temporary file
-	tempFile.Close()
+	if key.generation == table.Generation {
+		return table, release
+	}
+	current := *table
+	current.Generation = key.generation
+	return &current, release
+}
+
+// generationInUse checks if a reader pinned the files a table has in a generation
+func (tm *TableManager) generationInUse(table *Table, generation int) bool {
+	tm.generationsMu.Lock()
+	defer tm.generationsMu.Unlock()
 
-	// Replace the old file with the new one
-	err = os.Rename(tempRefPath, refFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to replace ref field file: %v", err)
+	return tm.readers[tableGeneration{table: table.ID(), generation: generation}] > 0
+}
+
+// forgetGeneration drops the generation of a dropped or renamed table
+func (tm *TableManager) forgetGeneration(table *Table) {
+	tm.generationsMu.Lock()
+	defer tm.generationsMu.Unlock()
+
+	delete(tm.generations, table.ID())
+}
+
+// removeOldGenerations removes the files compactions left behind when the database was closed: the files of the
+// generation before the current one and the files of a compaction that was interrupted before it switched over
+func (db *HTDB) removeOldGenerations() error {
+	return db.forEachTable(func(table *Table) error {
+		tm := db.GetTableManager()
+		if table.Generation > 0 {
+			tm.removeGeneration(table, table.Generation-1)
+		}
+		tm.removeGeneration(table, table.Generation+1)
+		return nil
+	})
+}
+
+// retainedVersions returns the records that survive a cleanup, in table file order
+// A version is visible until the next version of its row is committed, versions that stopped being
+// visible before the horizon are dropped
+func retainedVersions(records []*Record, horizon int64) []*Record {
+	// Commit timestamp of the version that replaced each version
+	replacedAt := make(map[*Record]int64)
+	latest := make(map[int64]*Record)
+	for _, record := range records {
+		if previous, exists := latest[record.RowKey]; exists {
+			replacedAt[previous] = record.ID
+		}
+		latest[record.RowKey] = record
 	}
 
-	return nil
+	var retained []*Record
+	for _, record := range records {
+		if replaced, exists := replacedAt[record]; exists {
+			if replaced > horizon {
+				retained = append(retained, record)
+			}
+			continue
+		}
+
+		// The last version of a row, deleted rows are kept until the delete leaves the window
+		if record.Metadata.IsCurrent && (!record.Metadata.IsDeleted || record.ID > horizon) {
+			retained = append(retained, record)
+		}
+	}
+
+	return retained
 }
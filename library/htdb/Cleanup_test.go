@@ -0,0 +1,461 @@
+package htdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compactTestTable runs the cleanup of a table with a retention of 0, so every replaced version is dropped
+func compactTestTable(t *testing.T, db *HTDB, table *Table) error {
+	t.Helper()
+	if err := db.GetTableManager().SetHistoryRetention(0); err != nil {
+		t.Fatal(err)
+	}
+	worker := NewCleanupWorker(db, time.Hour)
+	return worker.cleanupTable("test", table.TableName)
+}
+
+func TestCleanupAbortsOnInvalidRefOffsets(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "text", Type: "ref", Length: 128}})
+
+	first, err := tm.InsertRecord(table, map[string]interface{}{"text": "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"text": "second"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second record is kept by the cleanup and points behind the end of the data file
+	records, err := table.GetAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records[1].RefOffsets["text"] = [2]int64{0, 1000}
+	if err := table.WriteRecords(records); err != nil {
+		t.Fatal(err)
+	}
+	tm.dropVersions(table)
+
+	if err := tm.DeleteRecord(table, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := compactTestTable(t, db, table); err == nil {
+		t.Fatal("compaction succeeded with invalid ref offsets")
+	}
+
+	stored, err := GetTable("test:a", db.GetMainPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Generation != table.Generation {
+		t.Fatalf("generation changed to %d after the compaction failed", stored.Generation)
+	}
+	records, err = table.GetAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("table file has %d records after the compaction failed, want 3", len(records))
+	}
+}
+
+// fileExists checks if a file exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// refCounts reads the reference counts of the values in the hash file of a dedup field by the hash of their content
+func refCounts(t *testing.T, table *Table, field string) map[[sha256.Size]byte]int64 {
+	t.Helper()
+	data, err := os.ReadFile(refHashPath(table.refPath(field)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[[sha256.Size]byte]int64)
+	for offset := 0; offset+refContentEntrySize <= len(data); offset += refContentEntrySize {
+		entry := decodeRefHash(data[offset : offset+refContentEntrySize])
+		counts[entry.hash] = entry.count
+	}
+	return counts
+}
+
+func TestCompactionWithRefAndDedupFields(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "text", Type: "ref", Length: 128, Compression: "zstd"},
+		{Name: "data", Type: Blob, Dedup: true},
+		{Name: "n", Type: Int, Length: 8},
+	})
+	if err := tm.CreateIndex(table, "n"); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := []byte(strings.Repeat("shared", 1000))
+	var records []*Record
+	for i := 0; i < 4; i++ {
+		record, err := tm.InsertRecord(table, map[string]interface{}{"text": fmt.Sprint("value ", i), "data": shared, "n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err := tm.DeleteRecord(table, records[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.UpdateRecord(table, records[1], map[string]interface{}{"text": "updated", "data": []byte("own value")}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := *table
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := GetTable("test:a", db.GetMainPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Generation != 1 {
+		t.Fatalf("generation is %d after the compaction, want 1", stored.Generation)
+	}
+	records, err = stored.GetAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("compacted table has %d records, want 3", len(records))
+	}
+
+	// The handle loaded before the compaction reads the new files
+	want := map[int64]string{1: "updated", 2: "value 2", 3: "value 3"}
+	found, err := tm.Select(table).Sort("n", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(want) {
+		t.Fatalf("query found %d records, want %d", len(found), len(want))
+	}
+	for _, record := range found {
+		n := record.FieldsData["n"].(int64)
+		text, err := record.ReadRefData(table.SchemaPath, table.TableName, "text")
+		if err != nil || text != want[n] {
+			t.Fatalf("record %d has text %q (%v), want %q", n, text, err, want[n])
+		}
+		data, err := record.ReadBlob(table.SchemaPath, table.TableName, "data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 1 && string(data) != "own value" || n != 1 && !bytes.Equal(data, shared) {
+			t.Fatalf("record %d has the wrong blob value (%d bytes)", n, len(data))
+		}
+	}
+	if record, err := tm.Select(table).Where("n", "=", 3).First(); err != nil || record.FieldsData["n"] != int64(3) {
+		t.Fatalf("index lookup after the compaction failed: %v", err)
+	}
+
+	// Values of dropped versions are gone, the shared value is stored once and new records share it
+	fileSize := func(path string) int64 {
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.Size()
+	}
+	if fileSize(stored.refPath("text")) >= fileSize(before.refPath("text")) {
+		t.Fatalf("ref file did not shrink: %d bytes, %d before", fileSize(stored.refPath("text")), fileSize(before.refPath("text")))
+	}
+	if entries := fileSize(refHashPath(stored.refPath("data"))) / refContentEntrySize; entries != 2 {
+		t.Fatalf("hash file lists %d values, want 2", entries)
+	}
+	size := fileSize(stored.refPath("data"))
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"data": shared, "n": 4}); err != nil {
+		t.Fatal(err)
+	}
+	if fileSize(stored.refPath("data")) != size {
+		t.Fatalf("blob file grew from %d to %d bytes for a stored value", size, fileSize(stored.refPath("data")))
+	}
+
+	// The files of the generation before stay until the next cleanup run
+	if !fileExists(before.dataPath()) || !fileExists(before.refPath("text")) {
+		t.Fatal("files of the previous generation were removed right away")
+	}
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range before.generationFiles() {
+		if fileExists(path) {
+			t.Fatalf("%s was left behind by the next cleanup run", filepath.Base(path))
+		}
+	}
+}
+
+func TestReadOnlyOpenIgnoresInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := createTestTable(t, db, "a", []Field{{Name: "text", Type: "ref", Length: 128}})
+	if _, err := db.GetTableManager().InsertRecord(table, map[string]interface{}{"text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A compaction wrote the files of the next generation but did not switch over
+	next := *table
+	next.Generation++
+	for _, path := range []string{next.dataPath(), next.refPath("text")} {
+		if err := os.WriteFile(path, []byte("unfinished"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := Open(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err = reader.GetTableManager().GetTable("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := reader.GetTableManager().Select(table).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := record.ReadRefData(table.SchemaPath, table.TableName, "text"); err != nil || text != "hello" {
+		t.Fatalf("expected 'hello', got %q (%v)", text, err)
+	}
+	reader.Close()
+
+	// Writers remove the files of the interrupted compaction
+	openTestDB(t, dir)
+	if fileExists(next.dataPath()) || fileExists(next.refPath("text")) {
+		t.Fatal("files of the interrupted compaction were left behind")
+	}
+}
+
+func TestDropTableRemovesFilesOfAllGenerations(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "text", Type: "ref", Length: 128, Dedup: true}})
+
+	first, err := tm.InsertRecord(table, map[string]interface{}{"text": "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"text": "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.DeleteRecord(table, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files of a compaction that did not switch over yet
+	next := *table
+	next.Generation = 2
+	if err := os.WriteFile(next.dataPath(), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := db.Schema("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.DropTable("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(schema.schemaPath, "a.*"))
+	if len(leftovers) != 0 {
+		t.Fatalf("files of the dropped table were left behind: %v", leftovers)
+	}
+}
+
+func TestUpdateOfRecordReadBeforeCompaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "d", Type: "ref", Length: 128},
+		{Name: "n", Type: Int, Length: 8},
+	})
+
+	dropped, err := tm.InsertRecord(table, map[string]interface{}{"d": "dropped", "n": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"d": "kept", "n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.DeleteRecord(table, dropped); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record is read before the compaction moves its ref value
+	record, err := tm.Select(table).Where("n", "=", 1).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction can't stage its ref offsets into the new files
+	tx := tm.BeginTransaction()
+	_, err = tx.StageUpdate(table, record, map[string]interface{}{"n": 2})
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusTableChanged {
+		t.Fatalf("expected StatusTableChanged, got %v", err)
+	}
+	tx.Rollback()
+
+	// The table manager updates the version it reads itself
+	if _, err := tm.UpdateRecord(table, record, map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	record, err = tm.Select(table).Where("n", "=", 2).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := record.ReadRefData(table.SchemaPath, table.TableName, "d"); err != nil || text != "kept" {
+		t.Fatalf("expected 'kept', got %q (%v)", text, err)
+	}
+}
+
+func TestDedupReferenceCounts(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "data", Type: Blob, Dedup: true},
+		{Name: "n", Type: Int, Length: 8},
+	})
+
+	shared, dropped, kept, unused := []byte("shared"), []byte("dropped"), []byte("kept"), []byte("unused")
+	var records []*Record
+	for i := 0; i < 3; i++ {
+		record, err := tm.InsertRecord(table, map[string]interface{}{"data": shared, "n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	// Every committed version counts, also the ones that keep the value or delete the row
+	if _, err := tm.UpdateRecord(table, records[0], map[string]interface{}{"n": 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.DeleteRecord(table, records[1]); err != nil {
+		t.Fatal(err)
+	}
+	record, err := tm.InsertRecord(table, map[string]interface{}{"data": dropped, "n": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.UpdateRecord(table, record, map[string]interface{}{"data": kept}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value of a transaction that was rolled back is stored without references
+	tx := tm.BeginTransaction()
+	if _, err := tx.StageInsert(table, map[string]interface{}{"data": unused, "n": 4}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	counts := refCounts(t, table, "data")
+	want := map[[sha256.Size]byte]int64{sha256.Sum256(shared): 5, sha256.Sum256(dropped): 1, sha256.Sum256(kept): 1, sha256.Sum256(unused): 0}
+	for hash, count := range want {
+		if counts[hash] != count {
+			t.Fatalf("value is counted %d times before the compaction, want %d", counts[hash], count)
+		}
+	}
+
+	// The compaction drops the replaced and deleted versions and the values no version refers to anymore
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+	table = tm.current(table)
+	counts = refCounts(t, table, "data")
+	want = map[[sha256.Size]byte]int64{sha256.Sum256(shared): 2, sha256.Sum256(kept): 1}
+	if len(counts) != len(want) {
+		t.Fatalf("hash file lists %d values after the compaction, want %d", len(counts), len(want))
+	}
+	for hash, count := range want {
+		if counts[hash] != count {
+			t.Fatalf("value is counted %d times after the compaction, want %d", counts[hash], count)
+		}
+	}
+
+	// New versions count on the compacted files
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"data": shared, "n": 5}); err != nil {
+		t.Fatal(err)
+	}
+	if count := refCounts(t, table, "data")[sha256.Sum256(shared)]; count != 3 {
+		t.Fatalf("value is counted %d times after an insert, want 3", count)
+	}
+}
+
+func TestCleanupKeepsGenerationsThatAreRead(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "text", Type: "ref", Length: 128}})
+	record, err := tm.InsertRecord(table, map[string]interface{}{"text": "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader started on generation 0 and is still running when two cleanup runs pass
+	reader, release := tm.pin(table)
+	if _, err := tm.UpdateRecord(table, record, map[string]interface{}{"text": "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+	records, err := reader.readAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record = records[len(records)-1]
+	if _, err := tm.UpdateRecord(table, record, map[string]interface{}{"text": "third"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fileExists(reader.dataPath()) || !fileExists(reader.refPath("text")) {
+		t.Fatal("files of a generation were removed while they were read")
+	}
+	if text, err := record.ReadRefData(reader.SchemaPath, reader.TableName, "text"); err != nil || text != "second" {
+		t.Fatalf("expected 'second', got %q (%v)", text, err)
+	}
+	if current := tm.current(table); current.Generation != 1 {
+		t.Fatalf("table was compacted to generation %d while the files of generation 0 were read", current.Generation)
+	}
+
+	// Once the reader is done the old files are removed and the table is compacted again
+	release()
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(reader.dataPath()) || fileExists(reader.refPath("text")) {
+		t.Fatal("files of generation 0 were left behind after the reader was done")
+	}
+	if current := tm.current(table); current.Generation != 2 {
+		t.Fatalf("table is in generation %d after the cleanup, want 2", current.Generation)
+	}
+}
@@ -0,0 +1,126 @@
+// Constraints.go
+// Description: Constraint checks for the HTDB library
+// Implements the Unique and PrimaryKey checks that run when a transaction is committed
+// Author: harto.dev
+
+package htdb
+
+import (
+	"fmt"
+)
+
+// HasConstraint checks if a field has a constraint
+func (f Field) HasConstraint(constraint Constraint) bool {
+	for _, c := range f.Constraints {
+		if c == constraint {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnique checks if the values of a field have to be unique
+func (f Field) IsUnique() bool {
+	return f.HasConstraint(Unique) || f.HasConstraint(PrimaryKey)
+}
+
+// validateConstraints checks that the constraints of the fields can be enforced
+func validateConstraints(fields []Field) error {
+	for _, f := range fields {
+		if f.IsUnique() && indexKeyLength(f) == 0 {
+			return fmt.Errorf("field '%s' of type '%s' can't be unique", f.Name, f.Type)
+		}
+		if f.IsUnique() && indexKeyLength(f) > btreeMaxKeyLength {
+			return fmt.Errorf("field '%s' is too long to be unique (max %d bytes)", f.Name, btreeMaxKeyLength)
+		}
+	}
+	return nil
+}
+
+// checkUniqueConstraints checks the staged records of a table against all unique fields
+func (tx *Transaction) checkUniqueConstraints(table *Table, records []*Record) error {
+	tm := tx.db.GetTableManager()
+
+	// Only the last staged version of a row is kept, stored versions of staged rows are replaced
+	latest := make(map[int64]*Record)
+	for _, record := range records {
+		latest[record.RowKey] = record
+	}
+
+	for _, field := range table.Fields {
+		if !field.IsUnique() {
+			continue
+		}
+
+		// Tables created before unique fields were indexed get their index now
+		if !table.hasIndex(field.Name) {
+			err := tm.CreateIndex(table, field.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		index, err := tm.openIndex(table, field)
+		if err != nil {
+			return err
+		}
+
+		// Values staged in this transaction, by index key
+		staged := make(map[string]*Record)
+
+		for _, record := range records {
+			if record.Metadata.IsDeleted || latest[record.RowKey] != record {
+				continue
+			}
+
+			stored, err := storedRecord(table, record)
+			if err != nil {
+				return err
+			}
+
+			if meta, exists := stored.FieldsMeta[field.Name]; !exists || meta.IsNull {
+				continue // Null values never collide
+			}
+
+			value := stored.FieldsData[field.Name]
+			key, err := encodeIndexKey(field, value)
+			if err != nil {
+				return err
+			}
+
+			// Duplicates within the same transaction
+			if _, exists := staged[string(key)]; exists {
+				return uniqueViolation(table, field, value)
+			}
+			staged[string(key)] = record
+
+			// Duplicates in the records that are already stored
+			var positions []int64
+			err = index.Range(key, key, true, true, func(key []byte, id, pos int64) bool {
+				positions = append(positions, pos)
+				return true
+			})
+			if err != nil {
+				return err
+			}
+
+			existing, err := tm.recordsAt(table, positions)
+			if err != nil {
+				return err
+			}
+
+			for _, e := range existing {
+				if e.Metadata.IsCurrent && !e.Metadata.IsDeleted && latest[e.RowKey] == nil {
+					return uniqueViolation(table, field, value)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// uniqueViolation returns the response for a value that already exists in a unique field
+func uniqueViolation(table *Table, field Field, value interface{}) Response {
+	return NewResponse(StatusUniqueViolation, fmt.Sprintf("Value '%v' of unique field '%s' already exists in table '%s'", value, field.Name, table.TableName))
+}
@@ -0,0 +1,59 @@
+package htdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFailedUniqueCheckLeavesStagedRecordsUnchanged(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	fields := []Field{{Name: "code", Type: String, Length: 16, Constraints: []Constraint{Unique}}}
+
+	var tables []*Table
+	for i := 0; i < 6; i++ {
+		tables = append(tables, createTestTable(t, db, fmt.Sprint("t", i), fields))
+	}
+	taken := tables[len(tables)-1]
+	if _, err := tm.InsertRecord(taken, map[string]interface{}{"code": "taken"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every table but the last one has a valid insert, tables are committed in no particular order
+	tx := tm.BeginTransaction()
+	var staged []*Record
+	for _, table := range tables {
+		record, err := tx.StageInsert(table, map[string]interface{}{"code": "taken"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		staged = append(staged, record)
+	}
+	type version struct {
+		id, prevID int64
+		metadata   RecordMetadata
+	}
+	before := make(map[*Record]version)
+	for _, record := range staged {
+		before[record] = version{record.ID, record.PrevID, record.Metadata}
+	}
+
+	err := tm.CommitTransaction(tx)
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusUniqueViolation {
+		t.Fatalf("expected StatusUniqueViolation, got %v", err)
+	}
+	for _, record := range staged {
+		if (version{record.ID, record.PrevID, record.Metadata}) != before[record] {
+			t.Fatalf("staged record changed by the failed commit: %+v, was %+v", record.Metadata, before[record].metadata)
+		}
+	}
+
+	if err := tm.RollbackTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables[:len(tables)-1] {
+		if count, err := tm.Select(table).Count(); err != nil || count != 0 {
+			t.Fatalf("table %s has %d records (%v) after the rollback", table.TableName, count, err)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// DDL.go
+// Description: Listing, dropping and renaming of schemas and tables for the HTDB library
+// A table is only dropped or renamed while no transaction holds a lock on it
+// Author: harto.dev
+
+package htdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// droppedSchemaPrefix marks schema directories that are being removed, they are skipped when schemas are listed
+const droppedSchemaPrefix = ".dropped-"
+
+// Name returns the name of the schema
+func (s *Schema) Name() string {
+	return s.name
+}
+
+// ListSchemas returns the names of all schemas in the database
+func (db *HTDB) ListSchemas() ([]string, error) {
+	entries, err := os.ReadDir(db.mainPath)
+	if err != nil {
+		return nil, NewResponse(StatusDbError, fmt.Sprint(err))
+	}
+
+	var schemas []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			schemas = append(schemas, entry.Name())
+		}
+	}
+
+	return schemas, nil
+}
+
+// ListTables returns the names of all tables in the schema
+func (s *Schema) ListTables() ([]string, error) {
+	return listTables(s.schemaPath)
+}
+
+// listTables returns the names of all tables in the catalog of a schema directory
+func listTables(schemaPath string) ([]string, error) {
+	catalog, err := readCatalog(schemaPath)
+	if err != nil {
+		return nil, NewResponse(StatusDbError, err.Error())
+	}
+
+	return catalog.tableNames(), nil
+}
+
+// DropSchema removes a schema with all of its tables
+func (db *HTDB) DropSchema(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	schema, err := db.Schema(name)
+	if err != nil {
+		return err
+	}
+
+	tables, err := schema.loadTables()
+	if err != nil {
+		return err
+	}
+
+	release, err := db.reserveTables(tables...)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for _, table := range tables {
+		db.forgetTable(table)
+	}
+
+	// The directory is moved out of the way first, so a crash never leaves a half removed schema behind
+	droppedPath := filepath.Join(db.mainPath, droppedSchemaPrefix+name)
+	os.RemoveAll(droppedPath)
+	err = os.Rename(schema.schemaPath, droppedPath)
+	if err != nil {
+		return NewResponse(StatusDbError, fmt.Sprint(err))
+	}
+	syncDir(db.mainPath)
+
+	err = os.RemoveAll(droppedPath)
+	if err != nil {
+		return NewResponse(StatusDbError, fmt.Sprint(err))
+	}
+
+	return nil
+}
+
+// RenameSchema renames a schema, handles of the schema and its tables have to be loaded again
+func (db *HTDB) RenameSchema(oldName, newName string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := checkName("Schema", newName); err != nil {
+		return err
+	}
+
+	schema, err := db.Schema(oldName)
+	if err != nil {
+		return err
+	}
+
+	newPath := filepath.Join(db.mainPath, newName)
+	if _, err := os.Stat(newPath); err == nil {
+		return NewResponse(StatusSchenaAlreadyExists, "Schema "+newName+" already exists")
+	}
+
+	tables, err := schema.loadTables()
+	if err != nil {
+		return err
+	}
+
+	release, err := db.reserveTables(tables...)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for _, table := range tables {
+		db.forgetTable(table)
+	}
+
+	err = os.Rename(schema.schemaPath, newPath)
+	if err != nil {
+		return NewResponse(StatusDbError, fmt.Sprint(err))
+	}
+	syncDir(db.mainPath)
+
+	return nil
+}
+
+// DropTable removes a table with its records, ref field data and indexes
+func (s *Schema) DropTable(name string) error {
+	if err := s.db.checkWritable(); err != nil {
+		return err
+	}
+
+	table, err := s.loadTable(name)
+	if err != nil {
+		return err
+	}
+
+	release, err := s.db.reserveTables(table)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The configuration might have changed before the table was reserved
+	table, err = s.loadTable(name)
+	if err != nil {
+		return err
+	}
+
+	s.db.forgetTable(table)
+
+	// Without its catalog entry the table is gone, the other files are only leftovers from here on
+	err = updateCatalog(s.schemaPath, func(catalog *schemaCatalog) error {
+		delete(catalog.Tables, name)
+		return nil
+	})
+	if err != nil {
+		return NewResponse(StatusDbError, err.Error())
+	}
+
+	for _, path := range table.filePaths() {
+		os.Remove(path)
+	}
+	os.Remove(table.dataPath() + ".temp")
+	os.Remove(table.dataPath() + ".upgrade")
+	os.Remove(table.migratePath())
+	syncDir(s.schemaPath)
+
+	return nil
+}
+
+// RenameTable renames a table, handles of the table have to be loaded again
+func (s *Schema) RenameTable(oldName, newName string) error {
+	if err := s.db.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := checkName("Table", newName); err != nil {
+		return err
+	}
+	if newName == "index" {
+		return NewResponse(StatusInvalidName, "Can't name a Table \"index\"")
+	}
+	if isGenerationName(newName) {
+		return NewResponse(StatusInvalidName, "Can't name a Table like the files of a compacted table")
+	}
+
+	table, err := s.loadTable(oldName)
+	if err != nil {
+		return err
+	}
+
+	renamed := *table
+	renamed.TableName = newName
+	if _, err := s.loadTable(newName); err == nil {
+		return NewResponse(StatusTableAlreadyExists, "Table "+newName+" already exists")
+	}
+	if _, err := os.Stat(renamed.dataPath()); err == nil {
+		return NewResponse(StatusTableAlreadyExists, "Table "+newName+" already exists")
+	}
+
+	release, err := s.db.reserveTables(table)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The configuration might have changed before the table was reserved
+	table, err = s.loadTable(oldName)
+	if err != nil {
+		return err
+	}
+
+	if table.Migration != nil {
+		return NewResponse(StatusTableBusy, "Table "+oldName+" has an unfinished migration")
+	}
+
+	s.db.forgetTable(table)
+
+	// The catalog entry under the new name replaces the old one and remembers it until all files are moved
+	renamed = *table
+	renamed.TableName = newName
+	renamed.RenamedFrom = oldName
+	err = updateCatalog(s.schemaPath, func(catalog *schemaCatalog) error {
+		delete(catalog.Tables, oldName)
+		catalog.Tables[newName] = &renamed
+		return nil
+	})
+	if err != nil {
+		return NewResponse(StatusDbError, err.Error())
+	}
+
+	err = finishRename(&renamed)
+	if err != nil {
+		return NewResponse(StatusDbError, err.Error())
+	}
+
+	return nil
+}
+
+// finishRename moves the files of a renamed table to its new name
+// Every step can be repeated, so an interrupted rename is finished when the database is opened
+func finishRename(table *Table) error {
+	old := *table
+	old.TableName = table.RenamedFrom
+
+	oldPaths := old.filePaths()
+	for i, path := range table.filePaths() {
+		if _, err := os.Stat(oldPaths[i]); err != nil {
+			continue
+		}
+
+		err := os.Rename(oldPaths[i], path)
+		if err != nil {
+			return fmt.Errorf("failed to rename %s: %v", filepath.Base(oldPaths[i]), err)
+		}
+	}
+
+	table.RenamedFrom = ""
+	err := table.saveConfig()
+	if err != nil {
+		return err
+	}
+	syncDir(table.SchemaPath)
+
+	return nil
+}
+
+// finishRenames finishes the table renames that were interrupted when the database was closed
+func (db *HTDB) finishRenames() error {
+	var renamed []*Table
+	err := db.forEachTable(func(table *Table) error {
+		if table.RenamedFrom != "" {
+			renamed = append(renamed, table)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, table := range renamed {
+		err := finishRename(table)
+		if err != nil {
+			return fmt.Errorf("failed to rename table '%s': %v", table.TableName, err)
+		}
+	}
+
+	return nil
+}
+
+// removeDroppedSchemas removes schema directories that were left over by an interrupted DropSchema
+func (db *HTDB) removeDroppedSchemas() {
+	entries, err := os.ReadDir(db.mainPath)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), droppedSchemaPrefix) {
+			os.RemoveAll(filepath.Join(db.mainPath, entry.Name()))
+		}
+	}
+}
+
+// reserveTables makes sure no transaction uses the tables and blocks commits until release is called
+// Transactions that lock one of the tables afterwards wait until the tables are released
+func (db *HTDB) reserveTables(tables ...*Table) (func(), error) {
+	tm := db.GetTableManager()
+	lockID := atomic.AddUint64(&transactionCounter, 1)
+
+	for _, table := range tables {
+		if tm.migrationRunning(table) {
+			tm.locks.releaseAll(lockID)
+			return nil, NewResponse(StatusTableBusy, "Table "+table.TableName+" is being migrated")
+		}
+
+		target := lockTarget{table: table.ID(), whole: true}
+		if !tm.locks.tryAcquire(lockID, target, LockExclusive) {
+			tm.locks.releaseAll(lockID)
+			return nil, NewResponse(StatusTableBusy, "Table "+table.TableName+" is used by a transaction")
+		}
+	}
+
+	db.commitMu.Lock()
+
+	// Logged commits have to be applied while the tables still exist under their names
+	if db.walDirty {
+		err := db.recoverWAL()
+		if err != nil {
+			db.commitMu.Unlock()
+			tm.locks.releaseAll(lockID)
+			return nil, fmt.Errorf("failed to apply logged commits: %v", err)
+		}
+		db.walDirty = false
+	}
+
+	return func() {
+		db.commitMu.Unlock()
+		tm.locks.releaseAll(lockID)
+	}, nil
+}
+
+// forgetTable closes the open indexes of a table and drops its cached versions in every generation it has files of
+func (db *HTDB) forgetTable(table *Table) {
+	tm := db.GetTableManager()
+	for generation := table.Generation - 1; generation <= table.Generation+1; generation++ {
+		if generation >= 0 {
+			tm.forgetFiles(table, generation)
+		}
+	}
+	tm.dropSequences(table)
+	tm.forgetGeneration(table)
+}
+
+// loadTable loads a table of the schema
+func (s *Schema) loadTable(name string) (*Table, error) {
+	table, err := GetTable(s.name+":"+name, s.db.mainPath)
+	if err != nil {
+		return nil, NewResponse(StatusTableDoesntExist, "Table "+name+" does not exist in schema "+s.name)
+	}
+	return table, nil
+}
+
+// loadTables loads all tables of the schema
+func (s *Schema) loadTables() ([]*Table, error) {
+	names, err := s.ListTables()
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]*Table, 0, len(names))
+	for _, name := range names {
+		table, err := s.loadTable(name)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+
+	return tables, nil
+}
+
+// filePaths returns the sequence file and the files of the table in its generation and the generations next to it,
+// the configuration is not included. Compactions leave files of the generation before and after the current one behind
+func (t *Table) filePaths() []string {
+	paths := []string{t.sequencePath()}
+	for generation := t.Generation - 1; generation <= t.Generation+1; generation++ {
+		if generation < 0 {
+			continue
+		}
+		other := *t
+		other.Generation = generation
+		paths = append(paths, other.generationFiles()...)
+	}
+	return paths
+}
+
+// generationFiles returns the table file and the ref, hash and index files of all fields in the generation of the handle
+func (t *Table) generationFiles() []string {
+	paths := []string{t.dataPath()}
+	for _, field := range t.Fields {
+		if isRefField(field) {
+			paths = append(paths, t.refPath(field.Name), refHashPath(t.refPath(field.Name)))
+		}
+		paths = append(paths, t.indexPath(field.Name))
+	}
+	return paths
+}
+
+// checkName checks the name of a schema or table, names become part of file paths
+func checkName(kind, name string) error {
+	if len(name) == 0 {
+		return NewResponse(StatusInvalidName, "You have to give the "+strings.ToLower(kind)+" a name")
+	}
+	if strings.HasPrefix(name, ".") || strings.ContainsAny(name, ":/\\") {
+		return NewResponse(StatusInvalidName, kind+" name "+name+" is not allowed")
+	}
+	return nil
+}
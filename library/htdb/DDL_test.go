@@ -0,0 +1,88 @@
+package htdb
+
+import (
+	"testing"
+	"time"
+)
+
+// compactWhileWaiting runs change while commits are blocked and compacts the table twice before change gets to reserve it
+func compactWhileWaiting(t *testing.T, db *HTDB, table *Table, change func() error) error {
+	t.Helper()
+	db.commitMu.Lock()
+	done := make(chan error)
+	go func() { done <- change() }()
+	time.Sleep(20 * time.Millisecond)
+
+	var err error
+	current := table
+	for i := 0; i < 2 && err == nil; i++ {
+		var records []*Record
+		records, err = current.readAllRecords()
+		if err == nil {
+			err = db.GetTableManager().compactTable(current, records, nil)
+		}
+		current, _ = GetTable(table.ID().String(), db.mainPath)
+	}
+	db.commitMu.Unlock()
+	if err != nil {
+		<-done
+		t.Fatal(err)
+	}
+	return <-done
+}
+
+func TestDropTableRemovesTheFilesOfACompaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	table := createTestTable(t, db, "a", []Field{{Name: "text", Type: "ref", Length: 128}})
+	if _, err := db.GetTableManager().InsertRecord(table, map[string]interface{}{"text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := db.Schema("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = compactWhileWaiting(t, db, table, func() error { return schema.DropTable("a") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted := *table
+	compacted.Generation = 2
+	for _, path := range compacted.filePaths() {
+		if fileExists(path) {
+			t.Fatalf("%s was left behind by the drop", path)
+		}
+	}
+}
+
+func TestRenameTableMovesTheFilesOfACompaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "text", Type: "ref", Length: 128}})
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := db.Schema("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = compactWhileWaiting(t, db, table, func() error { return schema.RenameTable("a", "b") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := tm.GetTable("test", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Generation != 2 {
+		t.Fatalf("renamed table is in generation %d, want the compacted generation 2", renamed.Generation)
+	}
+	record, err := tm.Select(renamed).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := record.ReadRefData(renamed.SchemaPath, renamed.TableName, "text"); err != nil || text != "hello" {
+		t.Fatalf("expected 'hello', got %q (%v)", text, err)
+	}
+}
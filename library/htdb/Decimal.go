@@ -0,0 +1,184 @@
+// Decimal.go
+// Description: Fixed-point decimal fields for the HTDB library
+// A decimal is stored as its unscaled value (the value times 10^scale) in a 16 byte two's complement integer,
+// records hold it as an exact *big.Rat
+// Author: harto.dev
+
+package htdb
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+const (
+	decimalLength           = 16 // 128 bit unscaled value
+	decimalMaxPrecision     = 38 // 10^38 still fits into 127 bits
+	decimalDefaultPrecision = 18
+)
+
+// two128 is 2^128, it converts negative unscaled values to two's complement and back
+var two128 = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// toRat converts a value to an exact rational number
+// Floats are converted from their shortest decimal representation, so 0.1 becomes exactly 1/10
+func toRat(value interface{}) (*big.Rat, bool) {
+	switch v := value.(type) {
+	case *big.Rat:
+		if v == nil {
+			return nil, false
+		}
+		return new(big.Rat).Set(v), true
+	case big.Rat:
+		return new(big.Rat).Set(&v), true
+	case *big.Int:
+		if v == nil {
+			return nil, false
+		}
+		return new(big.Rat).SetInt(v), true
+	case string:
+		return new(big.Rat).SetString(v)
+	case uint64:
+		return new(big.Rat).SetInt(new(big.Int).SetUint64(v)), true
+	case uint:
+		return new(big.Rat).SetInt(new(big.Int).SetUint64(uint64(v))), true
+	case float32:
+		return floatToRat(float64(v), 32)
+	case float64:
+		return floatToRat(v, 64)
+	}
+
+	if v, ok := toInt64(value); ok {
+		return new(big.Rat).SetInt64(v), true
+	}
+	return nil, false
+}
+
+// floatToRat converts a float with its shortest decimal representation
+func floatToRat(v float64, bitSize int) (*big.Rat, bool) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(strconv.FormatFloat(v, 'f', -1, bitSize))
+}
+
+// normalizeDecimal converts a value to the *big.Rat that is stored for a decimal field
+func normalizeDecimal(field Field, value interface{}) (interface{}, string) {
+	r, ok := toRat(value)
+	if s, isString := value.(string); isString && !ok {
+		return nil, fmt.Sprintf("'%s' is not a decimal number", s)
+	}
+	if !ok {
+		return nil, fmt.Sprintf("requires a decimal value (*big.Rat, string or number), got %T", value)
+	}
+
+	if _, reason := decimalUnscaled(field, r); reason != "" {
+		return nil, reason
+	}
+	return r, ""
+}
+
+// decimalUnscaled returns the unscaled value of a decimal, it has to fit the precision and scale of the field
+func decimalUnscaled(field Field, r *big.Rat) (*big.Int, string) {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(field.Scale)), nil)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(scale))
+	if !scaled.IsInt() {
+		return nil, fmt.Sprintf("has more than %d decimal places", field.Scale)
+	}
+
+	unscaled := new(big.Int).Set(scaled.Num())
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(field.Precision)), nil)
+	if new(big.Int).Abs(unscaled).Cmp(limit) >= 0 {
+		return nil, fmt.Sprintf("has too many digits, the maximum is %d with %d decimal places", field.Precision, field.Scale)
+	}
+
+	return unscaled, ""
+}
+
+// putDecimal writes the unscaled value of a decimal as a little endian two's complement integer
+func putDecimal(buf []byte, field Field, value interface{}) error {
+	r, ok := value.(*big.Rat)
+	if !ok {
+		return fmt.Errorf("field '%s' requires a *big.Rat value", field.Name)
+	}
+
+	unscaled, reason := decimalUnscaled(field, r)
+	if reason != "" {
+		return fmt.Errorf("field '%s' %s", field.Name, reason)
+	}
+
+	encodeDecimalBigEndian(buf, unscaled)
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return nil
+}
+
+// readDecimal reads the value of a decimal field written by putDecimal
+func readDecimal(buf []byte, field Field) *big.Rat {
+	be := make([]byte, len(buf))
+	for i := range buf {
+		be[len(buf)-1-i] = buf[i]
+	}
+
+	unscaled := new(big.Int).SetBytes(be)
+	if be[0]&0x80 != 0 {
+		unscaled.Sub(unscaled, two128)
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(field.Scale)), nil)
+	return new(big.Rat).SetFrac(unscaled, scale)
+}
+
+// encodeDecimalBigEndian writes an unscaled value as a 16 byte big endian two's complement integer
+func encodeDecimalBigEndian(buf []byte, unscaled *big.Int) {
+	v := unscaled
+	if v.Sign() < 0 {
+		v = new(big.Int).Add(v, two128)
+	}
+	v.FillBytes(buf[:decimalLength])
+}
+
+// encodeDecimalKey encodes a decimal for an index, values that don't fit the field can't be encoded
+func encodeDecimalKey(key []byte, field Field, value interface{}) error {
+	r, ok := toRat(value)
+	if !ok {
+		return fmt.Errorf("field '%s' requires a decimal value", field.Name)
+	}
+
+	unscaled, reason := decimalUnscaled(field, r)
+	if reason != "" {
+		return fmt.Errorf("field '%s' %s", field.Name, reason)
+	}
+
+	encodeDecimalBigEndian(key, unscaled)
+	// Flip the sign bit so negative numbers sort before positive ones
+	key[0] ^= 0x80
+	return nil
+}
+
+// compareDecimals compares two decimal values exactly
+func compareDecimals(a, b interface{}) (int, bool) {
+	x, okA := toRat(a)
+	y, okB := toRat(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	return x.Cmp(y), true
+}
+
+// validateDecimalField checks the precision and scale of a decimal field
+func validateDecimalField(f Field) error {
+	if f.Length != decimalLength {
+		return fmt.Errorf("field '%s' of type 'decimal' must have a length of %d bytes", f.Name, decimalLength)
+	}
+	if f.Precision < 1 || f.Precision > decimalMaxPrecision {
+		return fmt.Errorf("field '%s' of type 'decimal' must have a precision between 1 and %d", f.Name, decimalMaxPrecision)
+	}
+	if f.Scale < 0 || f.Scale > f.Precision {
+		return fmt.Errorf("field '%s' of type 'decimal' must have a scale between 0 and its precision", f.Name)
+	}
+	return nil
+}
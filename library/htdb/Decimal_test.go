@@ -0,0 +1,59 @@
+package htdb
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestDecimalFieldsStoreExactValues(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "price", Type: Decimal, Length: 16, Precision: 12, Scale: 2},
+		{Name: "weight", Type: Float, Length: 8},
+	})
+
+	values := []interface{}{"19.99", 0.1, "-5.5", big.NewRat(-12345678901, 100)}
+	for _, value := range values {
+		if _, err := tm.InsertRecord(table, map[string]interface{}{"price": value, "weight": 2.75}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := tm.Select(table).Sort("price", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-123456789.01", "-5.50", "0.10", "19.99"}
+	if len(records) != len(want) {
+		t.Fatalf("found %d records, want %d", len(records), len(want))
+	}
+	for i, record := range records {
+		price := record.FieldsData["price"].(*big.Rat)
+		if got := price.FloatString(2); got != want[i] {
+			t.Fatalf("record %d has the price %s, want %s", i, got, want[i])
+		}
+		if record.FieldsData["weight"] != 2.75 {
+			t.Fatalf("float is stored as %v, want 2.75", record.FieldsData["weight"])
+		}
+	}
+
+	// Comparisons are exact, with and without an index
+	check := func() {
+		t.Helper()
+		if count, err := tm.Select(table).Where("price", ">=", "0.1").Count(); err != nil || count != 2 {
+			t.Fatalf("price >= 0.1 matches %d records (%v), want 2", count, err)
+		}
+	}
+	check()
+	if err := tm.CreateIndex(table, "price"); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	for _, value := range []interface{}{"1.234", "12345678901.00", "abc"} {
+		if _, err := tm.InsertRecord(table, map[string]interface{}{"price": value}); err == nil {
+			t.Fatalf("%v was stored in a decimal(12, 2) field", value)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// FileLock.go
+// Description: Lock file for the HTDB library
+// A database directory is opened by one writer or by any number of readers at a time,
+// the platform specific parts are in FileLock_flock.go and FileLock_other.go
+// Author: harto.dev
+
+package htdb
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const lockFileName = "lock" + fileEnding
+
+// fileLock is the lock a database holds on its directory while it is open
+type fileLock struct {
+	file *os.File
+	path string
+}
+
+// lockFilePath returns the path of the lock file of a database directory
+func lockFilePath(mainPath string) string {
+	return filepath.Join(mainPath, lockFileName)
+}
+
+// writeOwner writes the process ID of the writer to the lock file, it only helps with debugging
+func (l *fileLock) writeOwner() {
+	l.file.Truncate(0)
+	l.file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	l.file.Sync()
+}
+
+// databaseLocked returns the error for a database that is opened by another process
+func databaseLocked(mainPath string, readOnly bool) Response {
+	if readOnly {
+		return NewResponse(StatusDatabaseLocked, "Database "+mainPath+" is opened for writing by another process")
+	}
+	return NewResponse(StatusDatabaseLocked, "Database "+mainPath+" is already opened by another process")
+}
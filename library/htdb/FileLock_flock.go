@@ -0,0 +1,61 @@
+// FileLock_flock.go
+// Description: Lock file for the HTDB library on systems with flock
+// The lock is held by the open file and released by the system when the process ends
+// Author: harto.dev
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package htdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// acquireFileLock locks a database directory, exclusive for a writer and shared for readers
+func acquireFileLock(mainPath string, readOnly bool) (*fileLock, error) {
+	path := lockFilePath(mainPath)
+
+	flag := os.O_RDWR | os.O_CREATE
+	how := syscall.LOCK_EX
+	if readOnly {
+		flag = os.O_RDONLY | os.O_CREATE
+		how = syscall.LOCK_SH
+	}
+
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		file.Close()
+		return nil, databaseLocked(mainPath, readOnly)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock database: %v", err)
+	}
+
+	lock := &fileLock{file: file, path: path}
+	if !readOnly {
+		lock.writeOwner()
+	}
+
+	return lock, nil
+}
+
+// release releases the lock, the lock file stays so other processes never lock a removed file
+func (l *fileLock) release() error {
+	if l.file == nil {
+		return nil
+	}
+
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
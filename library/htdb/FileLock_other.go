@@ -0,0 +1,54 @@
+// FileLock_other.go
+// Description: Lock file for the HTDB library on systems without flock
+// The writer creates the lock file exclusively and removes it again when the database is closed,
+// after a crash the lock file has to be removed by hand
+// Author: harto.dev
+
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package htdb
+
+import (
+	"fmt"
+	"os"
+)
+
+// acquireFileLock locks a database directory, readers only check that no writer has it open
+func acquireFileLock(mainPath string, readOnly bool) (*fileLock, error) {
+	path := lockFilePath(mainPath)
+
+	if readOnly {
+		if _, err := os.Stat(path); err == nil {
+			return nil, databaseLocked(mainPath, readOnly)
+		}
+		return &fileLock{path: path}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, databaseLocked(mainPath, readOnly)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lock file: %v", err)
+	}
+
+	lock := &fileLock{file: file, path: path}
+	lock.writeOwner()
+
+	return lock, nil
+}
+
+// release releases the lock by removing the lock file of the writer
+func (l *fileLock) release() error {
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(l.path)
+}
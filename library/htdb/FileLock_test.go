@@ -0,0 +1,41 @@
+package htdb
+
+import "testing"
+
+func TestDatabaseIsOpenedByOneWriterOrManyReaders(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestTable(t, writer, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+
+	for _, readOnly := range []bool{false, true} {
+		_, err := Open(dir, Options{ReadOnly: readOnly})
+		if response, ok := err.(Response); !ok || response.StatusCode != StatusDatabaseLocked {
+			t.Fatalf("expected StatusDatabaseLocked for a second open (read-only %v), got %v", readOnly, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers share the database and can't change it
+	var readers []*HTDB
+	for i := 0; i < 2; i++ {
+		reader, err := Open(dir, Options{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		readers = append(readers, reader)
+	}
+	table, err := readers[0].GetTableManager().GetTable("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readers[1].GetTableManager().InsertRecord(table, map[string]interface{}{"n": 1})
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusReadOnly {
+		t.Fatalf("expected StatusReadOnly for an insert by a reader, got %v", err)
+	}
+}
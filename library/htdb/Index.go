@@ -0,0 +1,348 @@
+// Index.go
+// Description: Secondary indexes for the HTDB library
+// Every indexed field gets its own B+tree file next to the table configuration
+// Author: harto.dev
+
+package htdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// CreateIndex creates a persistent index on a field of a table
+func (tm *TableManager) CreateIndex(table *Table, fieldName string) error {
+	if err := tm.db.checkWritable(); err != nil {
+		return err
+	}
+
+	// The configuration is written from the table, it has to match the one on disk
+	if err := tm.checkLayout(table); err != nil {
+		return err
+	}
+
+	field, exists := table.getField(fieldName)
+	if !exists {
+		return NewResponse(StatusFieldDoesntExist, "Field "+fieldName+" does not exist in table "+table.TableName)
+	}
+
+	if table.hasIndex(fieldName) {
+		return NewResponse(StatusIndexAlreadyExists, "Index on "+fieldName+" already exists")
+	}
+
+	if indexKeyLength(field) == 0 {
+		return NewResponse(StatusBadRequest, "Fields of type '"+string(field.Type)+"' can't be indexed")
+	}
+
+	if indexKeyLength(field) > btreeMaxKeyLength {
+		return NewResponse(StatusBadRequest, fmt.Sprintf("Field '%s' is too long to be indexed (max %d bytes)", fieldName, btreeMaxKeyLength))
+	}
+
+	// Remove leftovers of an earlier index on the same field
+	current, release := tm.pin(table)
+	defer release()
+	tm.closeIndex(current, fieldName)
+	os.Remove(current.indexPath(fieldName))
+
+	// Fill the index with all records that are already stored
+	_, err := tm.openIndex(current, field)
+	if err != nil {
+		return NewResponse(StatusDbError, err.Error())
+	}
+
+	table.Indexes = append(table.Indexes, fieldName)
+	err = table.saveConfig()
+	if err != nil {
+		return NewResponse(StatusDbError, err.Error())
+	}
+
+	return nil
+}
+
+// openIndex returns the index of a field, opened indexes are kept open by the table manager
+// A missing index file is built from the table file
+func (tm *TableManager) openIndex(table *Table, field Field) (*btree, error) {
+	tm.indexesMu.Lock()
+	defer tm.indexesMu.Unlock()
+
+	path := table.indexPath(field.Name)
+	if index, exists := tm.indexes[path]; exists {
+		return index, nil
+	}
+
+	_, err := os.Stat(path)
+	missing := os.IsNotExist(err)
+
+	index, err := openBTree(path, indexKeyLength(field))
+	if err != nil {
+		return nil, err
+	}
+
+	if missing {
+		err = buildIndex(index, table, field)
+		if err != nil {
+			index.Close()
+			os.Remove(path)
+			return nil, err
+		}
+	}
+
+	tm.indexes[path] = index
+	return index, nil
+}
+
+// closeIndex closes an open index of a field
+func (tm *TableManager) closeIndex(table *Table, fieldName string) {
+	tm.indexesMu.Lock()
+	defer tm.indexesMu.Unlock()
+
+	path := table.indexPath(fieldName)
+	if index, exists := tm.indexes[path]; exists {
+		index.Close()
+		delete(tm.indexes, path)
+	}
+}
+
+// buildIndex fills a new index with all records in the table file
+func buildIndex(index *btree, table *Table, field Field) error {
+	records, err := table.readAllRecords()
+	if err != nil {
+		return err
+	}
+
+	for pos, record := range records {
+		if err := insertIndexEntry(index, field, record, int64(pos)); err != nil {
+			return err
+		}
+	}
+
+	return index.Sync()
+}
+
+// rebuildIndexes recreates all indexes of a table, this is needed when record positions change
+func (tm *TableManager) rebuildIndexes(table *Table) error {
+	for _, name := range table.Indexes {
+		field, exists := table.getField(name)
+		if !exists {
+			continue
+		}
+
+		tm.closeIndex(table, name)
+		err := os.Remove(table.indexPath(name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove index on '%s': %v", name, err)
+		}
+
+		_, err = tm.openIndex(table, field)
+		if err != nil {
+			return fmt.Errorf("failed to rebuild index on '%s': %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// indexRecords adds records to all indexes of a table, positions are the positions of the records in the table file
+func (tm *TableManager) indexRecords(table *Table, records []*Record, positions []int64) error {
+	for _, name := range table.Indexes {
+		field, exists := table.getField(name)
+		if !exists {
+			continue
+		}
+
+		index, err := tm.openIndex(table, field)
+		if err != nil {
+			return err
+		}
+
+		for i, record := range records {
+			// Index the values the way they are stored in the table file
+			stored, err := storedRecord(table, record)
+			if err != nil {
+				return err
+			}
+
+			if err := insertIndexEntry(index, field, stored, positions[i]); err != nil {
+				return err
+			}
+		}
+
+		if err := index.Sync(); err != nil {
+			return fmt.Errorf("failed to sync index on '%s': %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// storedRecord returns a record the way it will be read back from the table file
+func storedRecord(table *Table, record *Record) (*Record, error) {
+	data, err := record.Serialize(table.Fields)
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeRecord(data, table.Fields)
+}
+
+// insertIndexEntry adds a record to an index, null values are not indexed
+func insertIndexEntry(index *btree, field Field, record *Record, pos int64) error {
+	if meta, exists := record.FieldsMeta[field.Name]; !exists || meta.IsNull {
+		return nil
+	}
+
+	value, exists := record.FieldsData[field.Name]
+	if !exists || value == nil {
+		return nil
+	}
+
+	key, err := encodeIndexKey(field, value)
+	if err != nil {
+		return err
+	}
+
+	return index.Insert(key, record.ID, pos)
+}
+
+// indexCandidates uses an index to find the positions of all records that can match a condition
+// It returns false if there is no index that can be used for the condition
+func (tm *TableManager) indexCandidates(table *Table, c condition) ([]int64, bool, error) {
+	if !table.hasIndex(c.field.Name) || c.value == nil {
+		return nil, false, nil
+	}
+
+	// Readers can't build missing index files
+	if _, err := os.Stat(table.indexPath(c.field.Name)); err != nil && tm.db.IsReadOnly() {
+		return nil, false, nil
+	}
+
+	key, err := encodeIndexKey(c.field, c.value)
+	if err != nil {
+		// Values that can't be encoded exactly (like 17.5 for an int field) fall back to a full scan
+		return nil, false, nil
+	}
+
+	// Stored strings are cut at the field length, so a longer value has to include its cut prefix
+	exact := true
+	if v, ok := c.value.(string); ok && len(v) > len(key) {
+		exact = false
+	}
+
+	var lo, hi []byte
+	loInclusive, hiInclusive := true, true
+	switch c.operator {
+	case "=", "==":
+		lo, hi = key, key
+	case "<":
+		hi, hiInclusive = key, !exact
+	case "<=":
+		hi = key
+	case ">":
+		lo, loInclusive = key, !exact
+	case ">=":
+		lo = key
+	default:
+		return nil, false, nil
+	}
+
+	index, err := tm.openIndex(table, c.field)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var positions []int64
+	err = index.Range(lo, hi, loInclusive, hiInclusive, func(key []byte, id, pos int64) bool {
+		positions = append(positions, pos)
+		return true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Read the records in the order of the table file
+	sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+	return positions, true, nil
+}
+
+// indexKeyLength returns the key length of an index on a field, 0 if the field can't be indexed
+func indexKeyLength(field Field) int {
+	switch field.Type {
+	case Int, TimeID, Serial, Float, Date, Timestamp, Duration:
+		return 8
+	case UUID:
+		return uuidLength
+	case Bool:
+		return 1
+	case Decimal:
+		return decimalLength
+	case String:
+		return int(field.Length)
+	}
+	return 0
+}
+
+// encodeIndexKey encodes a value so that the byte order of keys matches the order of the values
+func encodeIndexKey(field Field, value interface{}) ([]byte, error) {
+	key := make([]byte, indexKeyLength(field))
+
+	switch field.Type {
+	case Int, TimeID, Serial:
+		v, ok := toInt64(value)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires an integer value", field.Name)
+		}
+		// Flip the sign bit so negative numbers sort before positive ones
+		binary.BigEndian.PutUint64(key, uint64(v)^(1<<63))
+	case Float:
+		v, ok := toFloat64(value)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a number value", field.Name)
+		}
+		bits := math.Float64bits(v)
+		if bits&(1<<63) == 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		binary.BigEndian.PutUint64(key, bits)
+	case Bool:
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a bool value", field.Name)
+		}
+		if v {
+			key[0] = 1
+		}
+	case UUID:
+		v, ok := normalizeUUID(value)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a uuid value", field.Name)
+		}
+		u, _ := parseUUID(v)
+		copy(key, u)
+	case Decimal:
+		err := encodeDecimalKey(key, field, value)
+		if err != nil {
+			return nil, err
+		}
+	case Date, Timestamp, Duration:
+		v, ok := timeFieldToInt64(field, value)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a %s value", field.Name, timeGoType(field))
+		}
+		binary.BigEndian.PutUint64(key, uint64(v)^(1<<63))
+	case String:
+		v, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("field '%s' requires a string value", field.Name)
+		}
+		// Strings are padded with null bytes like in the table file
+		copy(key, v)
+	default:
+		return nil, fmt.Errorf("fields of type '%s' can't be indexed", field.Type)
+	}
+
+	return key, nil
+}
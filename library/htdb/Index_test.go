@@ -0,0 +1,82 @@
+package htdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIndexedQueriesMatchFullScans(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "n", Type: Int, Length: 8},
+		{Name: "name", Type: String, Length: 8},
+	})
+
+	var records []*Record
+	for i := 0; i < 50; i++ {
+		record, err := tm.InsertRecord(table, map[string]interface{}{"n": i % 10, "name": string(rune('a' + i%5))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	type query struct {
+		field, operator string
+		value           interface{}
+	}
+	queries := []query{{"n", "=", 3}, {"n", "<", 4}, {"n", ">=", 7}, {"name", "=", "c"}, {"name", ">", "b"}}
+	counts := func() []int {
+		t.Helper()
+		var result []int
+		for _, q := range queries {
+			count, err := tm.Select(table).Where(q.field, q.operator, q.value).Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, count)
+		}
+		return result
+	}
+	scanned := counts()
+
+	// Indexes are filled with the stored records and kept up to date by commits
+	for _, name := range []string{"n", "name"} {
+		if err := tm.CreateIndex(table, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tm.CreateIndex(table, "n"); err == nil {
+		t.Fatal("an index was created twice")
+	}
+	for i, want := range scanned {
+		if got := counts()[i]; got != want {
+			t.Fatalf("indexed query %v matches %d records, the full scan %d", queries[i], got, want)
+		}
+	}
+
+	if _, err := tm.UpdateRecord(table, records[3], map[string]interface{}{"n": 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.DeleteRecord(table, records[13]); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := tm.Select(table).Where("n", "=", 3).Count(); err != nil || count != scanned[0]-2 {
+		t.Fatalf("n = 3 matches %d records (%v) after an update and a delete, want %d", count, err, scanned[0]-2)
+	}
+
+	// A missing index file is rebuilt from the table file
+	db.Close()
+	if err := os.Remove(table.indexPath("n")); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, db.GetMainPath())
+	tm = db.GetTableManager()
+	if count, err := tm.Select(table).Where("n", "=", 100).Count(); err != nil || count != 1 {
+		t.Fatalf("n = 100 matches %d records (%v) after the index was rebuilt, want 1", count, err)
+	}
+	if !fileExists(table.indexPath("n")) {
+		t.Fatal("index file was not rebuilt")
+	}
+}
@@ -0,0 +1,262 @@
+// KeyFields.go
+// Description: Generated uuid and serial fields for the HTDB library
+// Both are set when a record is inserted and can't be changed afterwards. Serial fields count up per table,
+// the highest reserved value is kept in a sequence file next to the table so values keep growing after a restart
+// Author: harto.dev
+
+package htdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	uuidLength         = 16
+	defaultUUIDVersion = 7
+)
+
+// sequenceBlockSize is how many serial values are reserved with one write of the sequence file
+// Values that were reserved but not used before the database is closed are skipped
+const sequenceBlockSize = 32
+
+// tableSequences is the state of the serial fields of a table
+type tableSequences struct {
+	mu       sync.Mutex
+	next     map[string]int64 // Next value of each field
+	reserved map[string]int64 // Highest value of each field that is reserved in the sequence file
+}
+
+// isGeneratedField checks if the values of a field are generated by the database
+func isGeneratedField(field Field) bool {
+	return field.Type == TimeID || field.Type == UUID || field.Type == Serial
+}
+
+// sequencePath returns the path of the sequence file of the table
+func (t *Table) sequencePath() string {
+	return filepath.Join(t.SchemaPath, t.TableName+".seq"+fileEnding)
+}
+
+// generateFields sets the values of the uuid and serial fields of a new record
+func (tm *TableManager) generateFields(table *Table, data map[string]interface{}) error {
+	for _, field := range table.Fields {
+		switch field.Type {
+		case UUID:
+			value, err := newUUID(field.Version)
+			if err != nil {
+				return fmt.Errorf("failed to generate uuid for field '%s': %v", field.Name, err)
+			}
+			data[field.Name] = value
+		case Serial:
+			value, err := tm.nextSerial(table, field)
+			if err != nil {
+				return fmt.Errorf("failed to generate value for field '%s': %v", field.Name, err)
+			}
+			data[field.Name] = value
+		}
+	}
+	return nil
+}
+
+// nextSerial returns the next value of a serial field
+// Values of rolled back inserts are not used again
+func (tm *TableManager) nextSerial(table *Table, field Field) (int64, error) {
+	seqs, err := tm.tableSequences(table)
+	if err != nil {
+		return 0, err
+	}
+
+	seqs.mu.Lock()
+	defer seqs.mu.Unlock()
+
+	next, exists := seqs.next[field.Name]
+	if !exists {
+		reserved, saved := seqs.reserved[field.Name]
+		if !saved {
+			// Fields without a saved state (like renamed fields) continue after the highest stored value
+			current, release := tm.pin(table)
+			reserved, err = maxSerial(current, field)
+			release()
+			if err != nil {
+				return 0, err
+			}
+			seqs.reserved[field.Name] = reserved
+		}
+		next = reserved + 1
+	}
+
+	if next > seqs.reserved[field.Name] {
+		reserved := make(map[string]int64, len(seqs.reserved))
+		for name, value := range seqs.reserved {
+			reserved[name] = value
+		}
+		reserved[field.Name] = next + sequenceBlockSize - 1
+
+		err := writeSequenceFile(table.sequencePath(), reserved)
+		if err != nil {
+			return 0, err
+		}
+		seqs.reserved = reserved
+	}
+
+	seqs.next[field.Name] = next + 1
+	return next, nil
+}
+
+// tableSequences returns the serial state of a table, it is read from the sequence file the first time
+func (tm *TableManager) tableSequences(table *Table) (*tableSequences, error) {
+	tm.sequencesMu.Lock()
+	defer tm.sequencesMu.Unlock()
+
+	if seqs, exists := tm.sequences[table.ID()]; exists {
+		return seqs, nil
+	}
+
+	reserved, err := readSequenceFile(table.sequencePath())
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := &tableSequences{
+		next:     make(map[string]int64),
+		reserved: reserved,
+	}
+	tm.sequences[table.ID()] = seqs
+	return seqs, nil
+}
+
+// dropSequences forgets the serial state of a table, it is read from the sequence file again when needed
+func (tm *TableManager) dropSequences(table *Table) {
+	tm.sequencesMu.Lock()
+	defer tm.sequencesMu.Unlock()
+
+	delete(tm.sequences, table.ID())
+}
+
+// maxSerial returns the highest value of a serial field in the table file, 0 if there is none
+func maxSerial(table *Table, field Field) (int64, error) {
+	records, err := table.readAllRecords()
+	if err != nil {
+		return 0, err
+	}
+
+	var highest int64
+	for _, record := range records {
+		if v, ok := record.FieldsData[field.Name].(int64); ok && v > highest {
+			highest = v
+		}
+	}
+	return highest, nil
+}
+
+// readSequenceFile reads the reserved values of the serial fields, a missing file means nothing is reserved yet
+func readSequenceFile(path string) (map[string]int64, error) {
+	reserved := make(map[string]int64)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return reserved, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sequence file: %v", err)
+	}
+
+	err = json.Unmarshal(data, &reserved)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sequence file: %v", err)
+	}
+	return reserved, nil
+}
+
+// writeSequenceFile replaces the sequence file, it is synced before a reserved value is used
+func writeSequenceFile(path string, reserved map[string]int64) error {
+	data, err := json.Marshal(reserved)
+	if err != nil {
+		return fmt.Errorf("failed to serialize sequence file: %v", err)
+	}
+
+	tempPath := path + ".temp"
+	err = os.WriteFile(tempPath, data, 0644)
+	if err == nil {
+		err = syncFile(tempPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write sequence file: %v", err)
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return fmt.Errorf("failed to replace sequence file: %v", err)
+	}
+	syncDir(filepath.Dir(path))
+
+	return nil
+}
+
+// newUUID generates a random (version 4) or time ordered (version 7) uuid
+func newUUID(version int) (string, error) {
+	var u [uuidLength]byte
+	_, err := rand.Read(u[:])
+	if err != nil {
+		return "", err
+	}
+
+	if version == 7 {
+		// The first 48 bits are the Unix time in milliseconds, so uuids sort by creation time
+		var ms [8]byte
+		binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+		copy(u[:6], ms[2:])
+	}
+
+	u[6] = (u[6] & 0x0f) | byte(version<<4)
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 9562 variant
+	return formatUUID(u[:]), nil
+}
+
+// formatUUID formats 16 bytes in the canonical lower case form
+func formatUUID(u []byte) string {
+	h := hex.EncodeToString(u)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// parseUUID parses a uuid in the canonical form, with or without dashes
+func parseUUID(s string) ([]byte, bool) {
+	h := strings.ReplaceAll(s, "-", "")
+	if len(h) != 2*uuidLength {
+		return nil, false
+	}
+	u, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// normalizeUUID converts a uuid value to its canonical form
+func normalizeUUID(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		u, ok := parseUUID(v)
+		if !ok {
+			return "", false
+		}
+		return formatUUID(u), true
+	case [uuidLength]byte:
+		return formatUUID(v[:]), true
+	case []byte:
+		if len(v) != uuidLength {
+			return "", false
+		}
+		return formatUUID(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,68 @@
+package htdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratedKeyFields(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "uid", Type: UUID, Length: 16, Version: 7},
+		{Name: "no", Type: Serial, Length: 8},
+		{Name: "n", Type: Int, Length: 8},
+	})
+
+	var records []*Record
+	for i := 0; i < 3; i++ {
+		record, err := tm.InsertRecord(table, map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	seen := make(map[string]bool)
+	for i, record := range records {
+		uid := record.FieldsData["uid"].(string)
+		if seen[uid] || len(uid) != 36 || uid[14] != '7' {
+			t.Fatalf("record %d got the uuid %q, want a new version 7 uuid", i, uid)
+		}
+		seen[uid] = true
+		if record.FieldsData["no"] != int64(i+1) {
+			t.Fatalf("record %d got the serial %v, want %d", i, record.FieldsData["no"], i+1)
+		}
+	}
+
+	// Generated values can't be set and are found in any uuid notation
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"no": 10}); err == nil {
+		t.Fatal("a serial value was set by an insert")
+	}
+	uid := strings.ToUpper(strings.ReplaceAll(records[1].FieldsData["uid"].(string), "-", ""))
+	found, err := tm.Select(table).Where("uid", "=", uid).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.RowKey != records[1].RowKey {
+		t.Fatalf("uuid %s found row %d, want %d", uid, found.RowKey, records[1].RowKey)
+	}
+
+	// Values of rolled back inserts are skipped, serials keep growing after a restart
+	tx := tm.BeginTransaction()
+	if _, err := tx.StageInsert(table, map[string]interface{}{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.RollbackTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db = openTestDB(t, dir)
+	record, err := db.GetTableManager().InsertRecord(table, map[string]interface{}{"n": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if no := record.FieldsData["no"].(int64); no <= 4 {
+		t.Fatalf("insert after the restart got the serial %d, want one after 4", no)
+	}
+}
@@ -0,0 +1,242 @@
+// LockManager.go
+// Description: Lock manager for the HTDB library
+// Tracks row and table locks of all transactions, waits for locks until a context is done
+// and aborts the youngest transaction of a deadlock
+// Author: harto.dev
+
+package htdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// LockMode is the mode a row or a table is locked in
+type LockMode int
+
+const (
+	LockShared    LockMode = iota // Other transactions can lock the same row or table shared
+	LockExclusive                 // No other transaction can lock the same row or table
+)
+
+// lockTarget is a locked row, or a whole table if whole is set
+type lockTarget struct {
+	table  TableID
+	rowKey int64
+	whole  bool
+}
+
+// lockManager holds the locks of all transactions of a table manager
+// Locks are held until the transaction commits or rolls back
+type lockManager struct {
+	mu       sync.Mutex
+	holders  map[lockTarget]map[uint64]LockMode // Transactions holding a row or table
+	rows     map[TableID]map[uint64]LockMode    // Strongest row lock every transaction holds in a table
+	held     map[uint64][]lockTarget            // Targets locked by a transaction
+	waitsFor map[uint64][]uint64                // Waiting transaction -> transactions it waits for
+	aborted  map[uint64]bool                    // Deadlock victims that haven't noticed yet
+	changed  chan struct{}                      // Closed whenever locks are released or a victim is chosen
+}
+
+// newLockManager creates an empty lock manager
+func newLockManager() *lockManager {
+	return &lockManager{
+		holders:  make(map[lockTarget]map[uint64]LockMode),
+		rows:     make(map[TableID]map[uint64]LockMode),
+		held:     make(map[uint64][]lockTarget),
+		waitsFor: make(map[uint64][]uint64),
+		aborted:  make(map[uint64]bool),
+		changed:  make(chan struct{}),
+	}
+}
+
+// acquire locks a target for a transaction and waits until it is granted or the context is done
+func (lm *lockManager) acquire(ctx context.Context, txID uint64, target lockTarget, mode LockMode) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for {
+		if lm.aborted[txID] {
+			delete(lm.aborted, txID)
+			delete(lm.waitsFor, txID)
+			return deadlockError(target)
+		}
+
+		blockers := lm.blockers(txID, target, mode)
+		if len(blockers) == 0 {
+			delete(lm.waitsFor, txID)
+			lm.grant(txID, target, mode)
+			return nil
+		}
+
+		// Waiting would close a cycle, the youngest transaction in it is aborted
+		lm.waitsFor[txID] = blockers
+		if cycle := lm.findCycle(txID); cycle != nil {
+			victim := cycle[0]
+			for _, id := range cycle {
+				if id > victim {
+					victim = id
+				}
+			}
+
+			if victim == txID {
+				delete(lm.waitsFor, txID)
+				return deadlockError(target)
+			}
+
+			lm.aborted[victim] = true
+			lm.broadcast()
+		}
+
+		changed := lm.changed
+		lm.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			lm.mu.Lock()
+			delete(lm.waitsFor, txID)
+			return NewResponse(StatusLockTimeout, "Timed out waiting for a lock on "+target.String())
+		case <-changed:
+		}
+		lm.mu.Lock()
+	}
+}
+
+// tryAcquire locks a target for a transaction if no other transaction holds a conflicting lock, it never waits
+func (lm *lockManager) tryAcquire(txID uint64, target lockTarget, mode LockMode) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if len(lm.blockers(txID, target, mode)) > 0 {
+		return false
+	}
+
+	lm.grant(txID, target, mode)
+	return true
+}
+
+// blockers returns the transactions whose locks conflict with the requested lock
+func (lm *lockManager) blockers(txID uint64, target lockTarget, mode LockMode) []uint64 {
+	var blockers []uint64
+	conflicts := func(holders map[uint64]LockMode) {
+		for id, held := range holders {
+			if id != txID && (held == LockExclusive || mode == LockExclusive) {
+				blockers = append(blockers, id)
+			}
+		}
+	}
+
+	// Locks on the same target and on the whole table
+	conflicts(lm.holders[target])
+	if !target.whole {
+		conflicts(lm.holders[lockTarget{table: target.table, whole: true}])
+	} else {
+		// A table lock conflicts with the row locks in the table
+		conflicts(lm.rows[target.table])
+	}
+
+	return blockers
+}
+
+// grant records a granted lock, a shared lock that is held already can be upgraded
+func (lm *lockManager) grant(txID uint64, target lockTarget, mode LockMode) {
+	holders, exists := lm.holders[target]
+	if !exists {
+		holders = make(map[uint64]LockMode)
+		lm.holders[target] = holders
+	}
+
+	held, exists := holders[txID]
+	if !exists {
+		lm.held[txID] = append(lm.held[txID], target)
+	}
+	if !exists || mode > held {
+		holders[txID] = mode
+	}
+
+	if !target.whole {
+		rows, exists := lm.rows[target.table]
+		if !exists {
+			rows = make(map[uint64]LockMode)
+			lm.rows[target.table] = rows
+		}
+		if current, exists := rows[txID]; !exists || mode > current {
+			rows[txID] = mode
+		}
+	}
+}
+
+// releaseAll releases every lock of a transaction
+func (lm *lockManager) releaseAll(txID uint64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for _, target := range lm.held[txID] {
+		delete(lm.holders[target], txID)
+		if len(lm.holders[target]) == 0 {
+			delete(lm.holders, target)
+		}
+
+		delete(lm.rows[target.table], txID)
+		if len(lm.rows[target.table]) == 0 {
+			delete(lm.rows, target.table)
+		}
+	}
+
+	delete(lm.held, txID)
+	delete(lm.waitsFor, txID)
+	delete(lm.aborted, txID)
+	lm.broadcast()
+}
+
+// broadcast wakes up all waiting transactions
+func (lm *lockManager) broadcast() {
+	close(lm.changed)
+	lm.changed = make(chan struct{})
+}
+
+// findCycle returns the transactions of a waits-for cycle through a transaction, or nil if there is none
+// Victims that were already chosen don't count, they are about to release their locks
+func (lm *lockManager) findCycle(start uint64) []uint64 {
+	visited := make(map[uint64]bool)
+	var path []uint64
+
+	var visit func(id uint64) bool
+	visit = func(id uint64) bool {
+		path = append(path, id)
+		for _, next := range lm.waitsFor[id] {
+			if lm.aborted[next] {
+				continue
+			}
+			if next == start {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if visit(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+
+	if visit(start) {
+		return path
+	}
+	return nil
+}
+
+// String describes the target for error messages
+func (t lockTarget) String() string {
+	if t.whole {
+		return fmt.Sprintf("table '%s'", t.table)
+	}
+	return fmt.Sprintf("record %d in table '%s'", t.rowKey, t.table)
+}
+
+// deadlockError returns the error for the victim of a deadlock
+func deadlockError(target lockTarget) Response {
+	return NewResponse(StatusDeadlock, "Deadlock detected while waiting for a lock on "+target.String()+", the transaction was rolled back")
+}
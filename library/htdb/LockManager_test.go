@@ -0,0 +1,82 @@
+package htdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlockRollsBackTheYoungestTransaction(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	a, err := tm.InsertRecord(table, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tm.InsertRecord(table, map[string]interface{}{"n": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older := tm.BeginTransaction()
+	younger := tm.BeginTransaction()
+	if _, err := older.StageUpdate(table, a, map[string]interface{}{"n": 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := younger.StageUpdate(table, b, map[string]interface{}{"n": 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The younger transaction waits for the row of the older one, which then waits for the other row
+	waited := make(chan error)
+	go func() {
+		_, err := younger.StageUpdate(table, a, map[string]interface{}{"n": 30})
+		waited <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := older.StageUpdate(table, b, map[string]interface{}{"n": 40}); err != nil {
+		t.Fatalf("the older transaction lost the deadlock: %v", err)
+	}
+
+	err = <-waited
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusDeadlock {
+		t.Fatalf("expected StatusDeadlock, got %v", err)
+	}
+	if !younger.done() {
+		t.Fatal("the transaction that lost the deadlock was not rolled back")
+	}
+	if err := tm.CommitTransaction(older); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockWaitsEndAfterTheLockTimeout(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	record, err := tm.InsertRecord(table, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.SetLockTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	holder := tm.BeginTransaction()
+	defer tm.RollbackTransaction(holder)
+	if _, err := holder.StageUpdate(table, record, map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	waiter := tm.BeginTransaction()
+	defer tm.RollbackTransaction(waiter)
+	_, err = waiter.StageUpdate(table, record, map[string]interface{}{"n": 3})
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusLockTimeout {
+		t.Fatalf("expected StatusLockTimeout, got %v", err)
+	}
+
+	// Transactions that only read don't wait for the lock
+	if count, err := waiter.Select(table).Count(); err != nil || count != 1 {
+		t.Fatalf("reading transaction sees %d rows (%v), want 1", count, err)
+	}
+}
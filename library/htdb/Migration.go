@@ -0,0 +1,683 @@
+// Migration.go
+// Description: Column changes for the HTDB library
+// AddField, DropField, RenameField, ChangeFieldLength and ChangeFieldCompression rewrite the table file to the new
+// layout in the background.
+// The configuration keeps the old layout until the new table file is written, so the table stays readable
+// Author: harto.dev
+
+package htdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// FieldMigration is a pending change of the fields of a table, it is stored in the table configuration
+type FieldMigration struct {
+	LayoutVersion int                        `json:"layoutVersion"`      // Layout version of the table after the change
+	Fields        []Field                    `json:"fields"`             // Fields after the change
+	Previous      []Field                    `json:"previous"`           // Fields before the change
+	Sources       map[string]string          `json:"sources,omitempty"`  // New field name -> old field name of renamed fields
+	Defaults      map[string]json.RawMessage `json:"defaults,omitempty"` // Values of added fields for the existing records
+	Applied       bool                       `json:"applied"`            // The new fields are in the configuration, the new table file might not be in place yet
+}
+
+// migrationTask is a migration that runs in the background
+type migrationTask struct {
+	done chan struct{}
+	err  error
+}
+
+// AddField adds a field to the table, existing records get the default value
+// A NotNull field needs a default value, unique fields can only be added with a nil default
+func (t *Table) AddField(field Field, defaultValue interface{}) error {
+	return t.startMigration(func(current *Table, m *FieldMigration) error {
+		if _, exists := current.getField(field.Name); exists {
+			return NewResponse(StatusFieldAlreadyExists, "Field "+field.Name+" already exists in table "+current.TableName)
+		}
+
+		if field.HasConstraint(PrimaryKey) {
+			return NewResponse(StatusBadRequest, "The primary key of a table can't be changed")
+		}
+
+		if defaultValue == nil {
+			if field.HasConstraint(NotNull) {
+				return NewResponse(StatusBadRequest, "Field "+field.Name+" is NotNull and needs a default value")
+			}
+		} else {
+			if field.IsUnique() {
+				return NewResponse(StatusBadRequest, "Unique field "+field.Name+" can only be added without a default value")
+			}
+			if isGeneratedField(field) {
+				return NewResponse(StatusBadRequest, "Field "+field.Name+" is generated and can't have a default value")
+			}
+			if isRefField(field) {
+				return NewResponse(StatusBadRequest, "Field "+field.Name+" of type "+string(field.Type)+" can only be added without a default value")
+			}
+
+			value, reason := normalizeValue(field, defaultValue)
+			if reason != "" {
+				return NewResponse(StatusValidationFailed, "Default value of field "+field.Name+" "+reason)
+			}
+
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return NewResponse(StatusBadRequest, fmt.Sprint(err))
+			}
+			m.Defaults = map[string]json.RawMessage{field.Name: raw}
+		}
+
+		m.Fields = append(m.Fields, withDefaultLengths([]Field{field})...)
+		return nil
+	})
+}
+
+// DropField removes a field and its values from the table
+func (t *Table) DropField(name string) error {
+	return t.startMigration(func(current *Table, m *FieldMigration) error {
+		if name == "id" {
+			return NewResponse(StatusBadRequest, "The primary key of a table can't be changed")
+		}
+
+		if _, exists := current.getField(name); !exists {
+			return NewResponse(StatusFieldDoesntExist, "Field "+name+" does not exist in table "+current.TableName)
+		}
+
+		var fields []Field
+		for _, f := range m.Fields {
+			if f.Name != name {
+				fields = append(fields, f)
+			}
+		}
+		m.Fields = fields
+		return nil
+	})
+}
+
+// RenameField renames a field of the table, the values are kept
+func (t *Table) RenameField(oldName, newName string) error {
+	return t.startMigration(func(current *Table, m *FieldMigration) error {
+		if oldName == "id" || newName == "id" {
+			return NewResponse(StatusBadRequest, "The primary key of a table can't be changed")
+		}
+
+		if _, exists := current.getField(oldName); !exists {
+			return NewResponse(StatusFieldDoesntExist, "Field "+oldName+" does not exist in table "+current.TableName)
+		}
+
+		if _, exists := current.getField(newName); exists {
+			return NewResponse(StatusFieldAlreadyExists, "Field "+newName+" already exists in table "+current.TableName)
+		}
+
+		for i := range m.Fields {
+			if m.Fields[i].Name == oldName {
+				m.Fields[i].Name = newName
+			}
+		}
+		m.Sources = map[string]string{newName: oldName}
+		return nil
+	})
+}
+
+// ChangeFieldLength changes the length of a string field
+// The migration fails if a stored value is longer than the new length
+func (t *Table) ChangeFieldLength(name string, length uint) error {
+	return t.startMigration(func(current *Table, m *FieldMigration) error {
+		field, exists := current.getField(name)
+		if !exists {
+			return NewResponse(StatusFieldDoesntExist, "Field "+name+" does not exist in table "+current.TableName)
+		}
+
+		if field.Type != String {
+			return NewResponse(StatusBadRequest, "Only the length of string fields can be changed")
+		}
+
+		if length == 0 {
+			return NewResponse(StatusBadRequest, "Field "+name+" needs a length")
+		}
+
+		for i := range m.Fields {
+			if m.Fields[i].Name == name {
+				m.Fields[i].Length = length
+			}
+		}
+		return nil
+	})
+}
+
+// ChangeFieldCompression changes the compression of a ref or blob field to "zstd", "gzip" or "none"
+// Stored values keep the compression they were written with, only new values use the new setting
+func (t *Table) ChangeFieldCompression(name, compression string) error {
+	return t.startMigration(func(current *Table, m *FieldMigration) error {
+		field, exists := current.getField(name)
+		if !exists {
+			return NewResponse(StatusFieldDoesntExist, "Field "+name+" does not exist in table "+current.TableName)
+		}
+
+		if !isRefField(field) {
+			return NewResponse(StatusBadRequest, "Only ref and blob fields can be compressed")
+		}
+
+		for i := range m.Fields {
+			if m.Fields[i].Name == name {
+				m.Fields[i].Compression = compression
+			}
+		}
+		return nil
+	})
+}
+
+// WaitForMigration waits until the migration of the table is finished and loads the new fields into the table
+// Other handles of the table have to be loaded again with TableManager.GetTable
+func (t *Table) WaitForMigration() error {
+	if t.db == nil {
+		return NewResponse(StatusBadRequest, "Table "+t.TableName+" has to be loaded with TableManager.GetTable")
+	}
+
+	tm := t.db.GetTableManager()
+	tm.migrationsMu.Lock()
+	task, running := tm.migrations[t.ID()]
+	tm.migrationsMu.Unlock()
+
+	var err error
+	if running {
+		<-task.done
+		err = task.err
+	}
+
+	current, loadErr := GetTable(t.ID().String(), t.db.GetMainPath())
+	if loadErr != nil {
+		return loadErr
+	}
+	current.db = t.db
+	*t = *current
+
+	return err
+}
+
+// startMigration stores a change of the fields in the table configuration and rewrites the table file in the background
+// change gets the current configuration and a migration with a copy of the current fields to change
+func (t *Table) startMigration(change func(current *Table, m *FieldMigration) error) error {
+	if t.db == nil {
+		return NewResponse(StatusBadRequest, "Table "+t.TableName+" has to be loaded with TableManager.GetTable")
+	}
+
+	db := t.db
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	tm := db.GetTableManager()
+	tm.migrationsMu.Lock()
+	defer tm.migrationsMu.Unlock()
+
+	if _, running := tm.migrations[t.ID()]; running {
+		return NewResponse(StatusTableBusy, "Table "+t.TableName+" is already being migrated")
+	}
+
+	// Other handles might have changed the table, the change is based on the configuration on disk
+	current, err := GetTable(t.ID().String(), db.GetMainPath())
+	if err != nil {
+		return err
+	}
+
+	if current.Migration != nil {
+		return NewResponse(StatusTableBusy, "Table "+t.TableName+" has an unfinished migration")
+	}
+
+	m := &FieldMigration{
+		LayoutVersion: current.LayoutVersion + 1,
+		Fields:        append([]Field(nil), current.Fields...),
+		Previous:      current.Fields,
+	}
+	err = change(current, m)
+	if err != nil {
+		return err
+	}
+
+	err = validateMigrationFields(m.Fields)
+	if err != nil {
+		return NewResponse(StatusBadRequest, err.Error())
+	}
+
+	// From here on the migration is resumed when the database is opened after a crash
+	current.Migration = m
+	err = current.saveConfig()
+	if err != nil {
+		return NewResponse(StatusDbError, err.Error())
+	}
+
+	task := &migrationTask{done: make(chan struct{})}
+	tm.migrations[t.ID()] = task
+
+	go func() {
+		task.err = db.runMigration(current)
+
+		tm.migrationsMu.Lock()
+		delete(tm.migrations, t.ID())
+		tm.migrationsMu.Unlock()
+		close(task.done)
+	}()
+
+	return nil
+}
+
+// validateMigrationFields checks the fields a table gets after a change
+func validateMigrationFields(fields []Field) error {
+	names := make(map[string]bool)
+	for _, f := range fields {
+		if f.Name == "" || strings.ContainsAny(f.Name, ".:/\\") {
+			return fmt.Errorf("'%s' is not a valid field name", f.Name)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("field '%s' exists more than once", f.Name)
+		}
+		names[f.Name] = true
+
+		switch f.Type {
+		case Int, Float, Date, Timestamp, Duration:
+			if f.Length != 8 {
+				return fmt.Errorf("field '%s' of type '%s' must have a length of 8 bytes", f.Name, f.Type)
+			}
+		case String, Bool, TimeID, "ref", Blob, Decimal, UUID, Serial:
+		default:
+			return fmt.Errorf("field '%s' has unsupported type '%s'", f.Name, f.Type)
+		}
+	}
+
+	if err := validateFieldLengths(fields); err != nil {
+		return err
+	}
+	return validateConstraints(fields)
+}
+
+// runMigration rewrites the table file of a table with a pending migration
+// It waits until no transaction has staged changes in the table, commits to other tables only wait while the files are switched
+func (db *HTDB) runMigration(table *Table) error {
+	tm := db.GetTableManager()
+
+	// Transactions that changed rows of the table finish first, new ones wait until the migration is done
+	lockID := atomic.AddUint64(&transactionCounter, 1)
+	target := lockTarget{table: table.ID(), whole: true}
+	ctx, cancel := context.WithTimeout(context.Background(), tm.LockTimeout())
+	err := tm.locks.acquire(ctx, lockID, target, LockExclusive)
+	cancel()
+	if err != nil {
+		// Nothing was written yet, the change is dropped
+		return table.dropMigration(err)
+	}
+	defer tm.locks.releaseAll(lockID)
+
+	// Logged commits are written in the old layout and have to be applied first
+	err = db.lockCommits()
+	if err != nil {
+		return err
+	}
+	db.commitMu.Unlock()
+
+	return db.migrateTable(table)
+}
+
+// lockCommits takes the commit mutex and applies the logged commits that could not be applied yet
+func (db *HTDB) lockCommits() error {
+	db.commitMu.Lock()
+	if db.walDirty {
+		err := db.recoverWAL()
+		if err != nil {
+			db.commitMu.Unlock()
+			return fmt.Errorf("failed to apply logged commits: %v", err)
+		}
+		db.walDirty = false
+	}
+	return nil
+}
+
+// migrateTable writes the table file in the new layout, switches the configuration and moves the file into place
+// No transaction may have staged changes in the table, the commit mutex is only taken to switch the files
+func (db *HTDB) migrateTable(table *Table) error {
+	current, err := GetTable(table.ID().String(), db.mainPath)
+	if err != nil {
+		return err
+	}
+
+	m := current.Migration
+	if m == nil {
+		return nil
+	}
+
+	if !m.Applied {
+		err = current.writeMigratedRecords()
+		if err != nil {
+			// The old table file is untouched, the change is dropped
+			return current.dropMigration(err)
+		}
+	}
+
+	err = db.lockCommits()
+	if err != nil {
+		return err
+	}
+	defer db.commitMu.Unlock()
+
+	if !m.Applied {
+		// Indexes of fields that are gone are dropped, renamed fields keep their index
+		var indexes []string
+		for _, name := range current.Indexes {
+			for _, f := range m.Fields {
+				if f.Name == name || m.Sources[f.Name] == name {
+					indexes = append(indexes, f.Name)
+					break
+				}
+			}
+		}
+
+		current.Fields = m.Fields
+		current.Indexes = indexes
+		current.LayoutVersion = m.LayoutVersion
+		m.Applied = true
+		err = current.saveConfig()
+		if err != nil {
+			return fmt.Errorf("failed to write table configuration: %v", err)
+		}
+	}
+
+	return db.finishMigration(current)
+}
+
+// dropMigration removes the pending migration of the table and returns the error it failed with
+func (t *Table) dropMigration(cause error) error {
+	os.Remove(t.migratePath())
+	t.Migration = nil
+	err := t.saveConfig()
+	if err != nil {
+		return fmt.Errorf("%v, failed to write table configuration: %v", cause, err)
+	}
+	return cause
+}
+
+// finishMigration moves the new table file into place and updates the ref and index files
+// Every step can be repeated, so an interrupted migration is finished when the database is opened
+func (db *HTDB) finishMigration(table *Table) error {
+	m := table.Migration
+	tm := db.GetTableManager()
+
+	if _, err := os.Stat(table.migratePath()); err == nil {
+		err = os.Rename(table.migratePath(), table.dataPath())
+		if err != nil {
+			return fmt.Errorf("failed to replace table file: %v", err)
+		}
+	}
+
+	// Ref files follow their fields
+	previous := make(map[string]Field)
+	for _, f := range m.Previous {
+		previous[f.Name] = f
+	}
+	kept := make(map[string]bool)
+	for _, f := range m.Fields {
+		source := f.Name
+		if old, renamed := m.Sources[f.Name]; renamed {
+			source = old
+		}
+		kept[source] = true
+
+		if !isRefField(f) {
+			continue
+		}
+
+		if _, existed := previous[source]; existed && source != f.Name {
+			if _, err := os.Stat(table.refPath(source)); err == nil {
+				err = os.Rename(table.refPath(source), table.refPath(f.Name))
+				if err != nil {
+					return fmt.Errorf("failed to rename ref field file: %v", err)
+				}
+			}
+			if _, err := os.Stat(refHashPath(table.refPath(source))); err == nil {
+				err = os.Rename(refHashPath(table.refPath(source)), refHashPath(table.refPath(f.Name)))
+				if err != nil {
+					return fmt.Errorf("failed to rename ref hash file: %v", err)
+				}
+			}
+			forgetRefContent(table.refPath(source))
+			forgetRefContent(table.refPath(f.Name))
+		}
+
+		file, err := os.OpenFile(table.refPath(f.Name), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to create ref field file: %v", err)
+		}
+		file.Close()
+	}
+
+	for _, f := range m.Previous {
+		if !kept[f.Name] && isRefField(f) {
+			os.Remove(table.refPath(f.Name))
+			os.Remove(refHashPath(table.refPath(f.Name)))
+			forgetRefContent(table.refPath(f.Name))
+		}
+	}
+
+	// Index keys depend on the field layout, changed indexes are rebuilt when they are opened the next time
+	for _, f := range m.Previous {
+		tm.closeIndex(table, f.Name)
+		os.Remove(table.indexPath(f.Name))
+	}
+	for _, f := range m.Fields {
+		tm.closeIndex(table, f.Name)
+		if old, exists := previous[f.Name]; !exists || old.Length != f.Length || old.Type != f.Type || m.Sources[f.Name] != "" {
+			os.Remove(table.indexPath(f.Name))
+		}
+	}
+	tm.dropVersions(table)
+
+	table.Migration = nil
+	err := table.saveConfig()
+	if err != nil {
+		return fmt.Errorf("failed to write table configuration: %v", err)
+	}
+	syncDir(table.SchemaPath)
+
+	return nil
+}
+
+// writeMigratedRecords writes all records of the table in the layout of the pending migration
+func (t *Table) writeMigratedRecords() error {
+	m := t.Migration
+
+	defaults := make(map[string]interface{})
+	for _, f := range m.Fields {
+		raw, exists := m.Defaults[f.Name]
+		if !exists {
+			continue
+		}
+
+		value, err := decodeDefault(f, raw)
+		if err != nil {
+			return err
+		}
+		defaults[f.Name] = value
+	}
+
+	records, err := t.readAllRecords()
+	if err != nil {
+		return err
+	}
+
+	migrated := make([]*Record, len(records))
+	for i, record := range records {
+		migrated[i], err = migrateRecord(record, t.Fields, m, defaults)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeRecordsFile(t.migratePath(), m.Fields, migrated)
+}
+
+// migrateRecord copies a record into the layout of a migration
+func migrateRecord(record *Record, fields []Field, m *FieldMigration, defaults map[string]interface{}) (*Record, error) {
+	migrated := &Record{
+		ID:         record.ID,
+		Metadata:   record.Metadata,
+		FieldsData: make(map[string]interface{}),
+		FieldsMeta: make(map[string]FieldMetadata),
+		RefOffsets: make(map[string][2]int64),
+		PrevID:     record.PrevID,
+		RowKey:     record.RowKey,
+	}
+
+	old := make(map[string]bool)
+	for _, f := range fields {
+		old[f.Name] = true
+	}
+
+	for _, f := range m.Fields {
+		source := f.Name
+		if name, renamed := m.Sources[f.Name]; renamed {
+			source = name
+		}
+
+		// Added fields
+		if !old[source] {
+			value, exists := defaults[f.Name]
+			migrated.FieldsMeta[f.Name] = FieldMetadata{IsNull: !exists}
+			if exists {
+				migrated.FieldsData[f.Name] = value
+			}
+			continue
+		}
+
+		meta := record.FieldsMeta[source]
+		migrated.FieldsMeta[f.Name] = meta
+		if value, exists := record.FieldsData[source]; exists {
+			if s, ok := value.(string); ok && f.Type == String && len(s) > int(f.Length) && !meta.IsNull {
+				return nil, NewResponse(StatusValidationFailed, fmt.Sprintf("Value of field '%s' in record %d is %d bytes long, the new length is %d", f.Name, record.RowKey, len(s), f.Length))
+			}
+			migrated.FieldsData[f.Name] = value
+		}
+		if offsets, exists := record.RefOffsets[source]; exists {
+			migrated.RefOffsets[f.Name] = offsets
+		}
+	}
+
+	return migrated, nil
+}
+
+// decodeDefault reads the stored default value of an added field
+func decodeDefault(field Field, raw json.RawMessage) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read default value of field '%s': %v", field.Name, err)
+	}
+
+	// Decimals are read exactly, big.Rat writes whole numbers as JSON numbers and fractions as strings
+	if field.Type == Decimal {
+		if n, ok := value.(json.Number); ok {
+			value = n.String()
+		}
+		r, ok := toRat(value)
+		if !ok {
+			return nil, fmt.Errorf("failed to read default value of field '%s': not a decimal", field.Name)
+		}
+		return r, nil
+	}
+
+	if n, ok := value.(json.Number); ok {
+		if field.Type == Int || field.Type == Duration {
+			value, err = n.Int64()
+		} else {
+			value, err = n.Float64()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read default value of field '%s': %v", field.Name, err)
+		}
+	}
+
+	if isTimeField(field) {
+		value, err = parseTimeDefault(field, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read default value of field '%s': %v", field.Name, err)
+		}
+	}
+
+	return value, nil
+}
+
+// resumeMigrations finishes the migrations that were interrupted when the database was closed
+func (db *HTDB) resumeMigrations() error {
+	return db.forEachTable(func(table *Table) error {
+		if table.Migration == nil {
+			return nil
+		}
+
+		err := db.migrateTable(table)
+		if err != nil {
+			return fmt.Errorf("failed to migrate table '%s': %v", table.TableName, err)
+		}
+		return nil
+	})
+}
+
+// waitForMigrations waits until all migrations that run in the background are finished
+func (tm *TableManager) waitForMigrations() {
+	tm.migrationsMu.Lock()
+	var tasks []*migrationTask
+	for _, task := range tm.migrations {
+		tasks = append(tasks, task)
+	}
+	tm.migrationsMu.Unlock()
+
+	for _, task := range tasks {
+		<-task.done
+	}
+}
+
+// migrationRunning checks if a migration of the table runs in the background
+func (tm *TableManager) migrationRunning(table *Table) bool {
+	tm.migrationsMu.Lock()
+	defer tm.migrationsMu.Unlock()
+
+	_, running := tm.migrations[table.ID()]
+	return running
+}
+
+// checkLayout returns an error if the fields of the table were changed after it was loaded or are being changed
+func (tm *TableManager) checkLayout(table *Table) error {
+	if tm.migrationRunning(table) {
+		return NewResponse(StatusTableBusy, "Table "+table.TableName+" is being migrated")
+	}
+
+	current, err := GetTable(table.ID().String(), tm.db.GetMainPath())
+	if err != nil {
+		return err
+	}
+
+	if current.LayoutVersion != table.LayoutVersion {
+		return tableChanged(table)
+	}
+	return nil
+}
+
+// tableChanged returns the response for a table handle whose fields are outdated
+func tableChanged(table *Table) Response {
+	return NewResponse(StatusTableChanged, "Fields of table "+table.TableName+" were changed, load the table again")
+}
+
+// tableCompacted returns the response for records or handles that name files the table had before a compaction
+func tableCompacted(tableName string) Response {
+	return NewResponse(StatusTableChanged, "Table "+tableName+" was compacted, load the table and read the records again")
+}
+
+// migratePath returns the path the table file is written to during a migration
+func (t *Table) migratePath() string {
+	return t.dataPath() + ".migrate"
+}
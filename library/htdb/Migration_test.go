@@ -0,0 +1,326 @@
+package htdb
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddFieldFillsExistingRecords(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "text", Type: "ref", Length: 128},
+		{Name: "n", Type: Int, Length: 8},
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := tm.InsertRecord(table, map[string]interface{}{"text": "hello", "n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := table.AddField(Field{Name: "flag", Type: Bool}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WaitForMigration(); err != nil {
+		t.Fatal(err)
+	}
+	if table.Migration != nil {
+		t.Fatal("migration is still pending after WaitForMigration")
+	}
+
+	records, err := tm.Select(table).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("found %d records after the migration, want 2", len(records))
+	}
+	for _, record := range records {
+		if record.FieldsData["flag"] != true {
+			t.Fatalf("record %d has flag %v, want the default true", record.RowKey, record.FieldsData["flag"])
+		}
+		if text, err := record.ReadRefData(table.SchemaPath, table.TableName, "text"); err != nil || text != "hello" {
+			t.Fatalf("expected 'hello', got %q (%v)", text, err)
+		}
+	}
+
+	record, err := tm.InsertRecord(table, map[string]interface{}{"text": "new", "n": 2, "flag": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.FieldsData["flag"] != false {
+		t.Fatalf("new record has flag %v, want false", record.FieldsData["flag"])
+	}
+}
+
+func TestRenameFieldKeepsValuesAndIndexes(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "text", Type: "ref", Length: 128, Dedup: true},
+		{Name: "n", Type: Int, Length: 8},
+	})
+	if err := tm.CreateIndex(table, "n"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := tm.InsertRecord(table, map[string]interface{}{"text": "shared", "n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := table.RenameField("text", "body"); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WaitForMigration(); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.RenameField("n", "m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WaitForMigration(); err != nil {
+		t.Fatal(err)
+	}
+
+	indexed := make(map[string]bool)
+	for _, name := range table.Indexes {
+		indexed[name] = true
+	}
+	if !indexed["m"] || indexed["n"] {
+		t.Fatalf("indexes after the rename are %v, want the index on n renamed to m", table.Indexes)
+	}
+	record, err := tm.Select(table).Where("m", "=", 1).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := record.ReadRefData(table.SchemaPath, table.TableName, "body"); err != nil || text != "shared" {
+		t.Fatalf("expected 'shared', got %q (%v)", text, err)
+	}
+	if fileExists(table.refPath("text")) || fileExists(refHashPath(table.refPath("text"))) {
+		t.Fatal("ref files of the old field name were left behind")
+	}
+
+	// The hash file moved with the data file, new values are shared with the stored ones
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"body": "shared", "m": 3}); err != nil {
+		t.Fatal(err)
+	}
+	counts := refCounts(t, table, "body")
+	if len(counts) != 1 || counts[sha256.Sum256([]byte("shared"))] != 4 {
+		t.Fatalf("renamed field has the counts %v, want one value counted 4 times", counts)
+	}
+}
+
+func TestDropFieldRemovesItsRefFiles(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "text", Type: "ref", Length: 128, Dedup: true},
+		{Name: "n", Type: Int, Length: 8},
+	})
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"text": "hello", "n": 7}); err != nil {
+		t.Fatal(err)
+	}
+	refPath := table.refPath("text")
+
+	if err := table.DropField("text"); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WaitForMigration(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, exists := table.getField("text"); exists {
+		t.Fatal("dropped field is still in the table configuration")
+	}
+	if fileExists(refPath) || fileExists(refHashPath(refPath)) {
+		t.Fatal("ref files of the dropped field were left behind")
+	}
+	record, err := tm.Select(table).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := record.FieldsData["text"]; exists || record.FieldsData["n"] != int64(7) {
+		t.Fatalf("record has the fields %v after the drop", record.FieldsData)
+	}
+
+	if err := table.DropField("id"); err == nil {
+		t.Fatal("the primary key was dropped")
+	}
+}
+
+func TestChangeFieldLengthChecksStoredValues(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "name", Type: String, Length: 16}})
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"name": "twelve bytes"}); err != nil {
+		t.Fatal(err)
+	}
+	layout := table.LayoutVersion
+
+	// A stored value is longer than the new length, the migration is dropped
+	if err := table.ChangeFieldLength("name", 4); err != nil {
+		t.Fatal(err)
+	}
+	err := table.WaitForMigration()
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusValidationFailed {
+		t.Fatalf("expected StatusValidationFailed, got %v", err)
+	}
+	if field, _ := table.getField("name"); field.Length != 16 || table.Migration != nil || table.LayoutVersion != layout {
+		t.Fatalf("table changed after the migration failed: length %d, layout %d", field.Length, table.LayoutVersion)
+	}
+
+	if err := table.ChangeFieldLength("name", 32); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WaitForMigration(); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 32)
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"name": long}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := tm.Select(table).Sort("name", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].FieldsData["name"] != "twelve bytes" || records[1].FieldsData["name"] != long {
+		t.Fatalf("unexpected records after the migration: %d", len(records))
+	}
+}
+
+func TestChangeFieldCompressionKeepsStoredValues(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "text", Type: "ref", Length: 128},
+		{Name: "n", Type: Int, Length: 8},
+	})
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"text": "plain", "n": 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := table.ChangeFieldCompression("text", "zstd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WaitForMigration(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"text": "compressed", "n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(table.refPath("text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]struct {
+		text  string
+		codec byte
+	}{0: {"plain", refCodecNone}, 1: {"compressed", refCodecZstd}}
+	records, err := tm.Select(table).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		n := record.FieldsData["n"].(int64)
+		if codec := data[record.RefOffsets["text"][0]]; codec != want[n].codec {
+			t.Fatalf("record %d is stored with compression %d, want %d", n, codec, want[n].codec)
+		}
+		if text, err := record.ReadRefData(table.SchemaPath, table.TableName, "text"); err != nil || text != want[n].text {
+			t.Fatalf("expected %q, got %q (%v)", want[n].text, text, err)
+		}
+	}
+
+	if err := table.ChangeFieldCompression("n", "zstd"); err == nil {
+		t.Fatal("an int field was set to be compressed")
+	}
+}
+
+func TestMigrationResumesWhenTheDatabaseIsOpened(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	if _, err := db.GetTableManager().InsertRecord(table, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The migration was stored in the configuration but the table file was not rewritten
+	fields := append(append([]Field(nil), table.Fields...), Field{Name: "m", Type: Int, Length: 8})
+	table.Migration = &FieldMigration{
+		LayoutVersion: table.LayoutVersion + 1,
+		Fields:        fields,
+		Previous:      table.Fields,
+		Defaults:      map[string]json.RawMessage{"m": json.RawMessage("5")},
+	}
+	if err := table.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, dir)
+	table, err = db.GetTableManager().GetTable("test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Migration != nil {
+		t.Fatal("migration is still pending after the database was opened")
+	}
+	record, err := db.GetTableManager().Select(table).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.FieldsData["n"] != int64(1) || record.FieldsData["m"] != int64(5) {
+		t.Fatalf("record has the fields %v after the migration", record.FieldsData)
+	}
+}
+
+func TestMigrationIsDroppedWhenTheTableStaysLocked(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	other := createTestTable(t, db, "b", []Field{{Name: "n", Type: Int, Length: 8}})
+	record, err := tm.InsertRecord(table, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.SetLockTimeout(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction keeps a row of the table locked while the migration waits for it
+	tx := tm.BeginTransaction()
+	if _, err := tx.StageUpdate(table, record, map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.AddField(Field{Name: "m", Type: Int, Length: 8}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.InsertRecord(other, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = table.WaitForMigration()
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusLockTimeout {
+		t.Fatalf("expected StatusLockTimeout, got %v", err)
+	}
+	if table.Migration != nil || len(table.Fields) != 2 {
+		t.Fatalf("table has %d fields and the migration %v after the lock timed out", len(table.Fields), table.Migration)
+	}
+	if err := tm.CommitTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := table.AddField(Field{Name: "m", Type: Int, Length: 8}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WaitForMigration(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,681 @@
+// Query.go
+// Description: Query builder for the HTDB library
+// Implements Select with Where, Sort, Limit and Offset on top of the TableManager
+// Author: harto.dev
+
+package htdb
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Query represents a select query on a single table
+type Query struct {
+	tm         *TableManager
+	table      *Table
+	conditions []condition
+	sorts      []sortOrder
+	limit      int
+	offset     int
+	asOf       int64        // Read the versions that were current at this timestamp, 0 reads the current versions
+	tx         *Transaction // Transaction whose staged changes are visible to the query
+	err        error        // First error that occurred while building the query
+
+	refValues map[refValueKey]string // Ref values read for sorting while the query runs, they are not put into the records
+}
+
+// refValueKey identifies a ref value read by a query
+type refValueKey struct {
+	record *Record
+	field  string
+}
+
+// condition is a single Where predicate
+type condition struct {
+	field    Field
+	operator string
+	value    interface{}
+}
+
+// sortOrder is a single Sort instruction
+type sortOrder struct {
+	field     Field
+	ascending bool
+}
+
+// Supported Where operators
+var queryOperators = map[string]bool{
+	"=":  true,
+	"==": true,
+	"!=": true,
+	"<":  true,
+	"<=": true,
+	">":  true,
+	">=": true,
+}
+
+// Select starts a new query on a table
+func (tm *TableManager) Select(table *Table) *Query {
+	q := &Query{
+		tm:     tm,
+		table:  table,
+		limit:  -1,
+		offset: 0,
+	}
+	if table == nil {
+		q.err = NewResponse(StatusTableDoesntExist, "Select needs a table")
+	}
+	return q
+}
+
+// Where adds a filter to the query, all conditions have to match (AND)
+func (q *Query) Where(field string, operator string, value interface{}) *Query {
+	if q.err != nil {
+		return q
+	}
+
+	f, ok := q.lookupField(field)
+	if !ok {
+		return q
+	}
+
+	if !queryOperators[operator] {
+		q.err = NewResponse(StatusBadRequest, "Unknown operator '"+operator+"'")
+		return q
+	}
+
+	if value == nil && operator != "=" && operator != "==" && operator != "!=" {
+		q.err = NewResponse(StatusBadRequest, "Operator '"+operator+"' can't be used with nil")
+		return q
+	}
+
+	// Blob values are only read as streams, they can only be checked for nil
+	if value != nil && f.Type == Blob {
+		q.err = NewResponse(StatusBadRequest, "Blob field '"+field+"' can only be compared with nil")
+		return q
+	}
+
+	// Uuids are compared in their canonical form
+	if value != nil && f.Type == UUID {
+		normalized, ok := normalizeUUID(value)
+		if !ok {
+			q.err = NewResponse(StatusBadRequest, fmt.Sprintf("Field '%s' requires a uuid value, got %v", field, value))
+			return q
+		}
+		value = normalized
+	}
+
+	// Dates are compared by the day of the value like they are stored
+	if value != nil && isTimeField(f) {
+		normalized, reason := normalizeTimeValue(f, value)
+		if reason != "" {
+			q.err = NewResponse(StatusBadRequest, "Field '"+field+"' "+reason)
+			return q
+		}
+		value = normalized
+	}
+
+	q.conditions = append(q.conditions, condition{field: f, operator: operator, value: value})
+	return q
+}
+
+// Sort adds a sort order to the query, earlier calls take precedence
+func (q *Query) Sort(field string, ascending bool) *Query {
+	if q.err != nil {
+		return q
+	}
+
+	f, ok := q.lookupField(field)
+	if !ok {
+		return q
+	}
+
+	if f.Type == Blob {
+		q.err = NewResponse(StatusBadRequest, "Can't sort by blob field '"+field+"'")
+		return q
+	}
+
+	q.sorts = append(q.sorts, sortOrder{field: f, ascending: ascending})
+	return q
+}
+
+// Limit limits the number of returned records, a negative value means no limit
+func (q *Query) Limit(limit int) *Query {
+	q.limit = limit
+	return q
+}
+
+// Offset skips the first n matching records
+func (q *Query) Offset(offset int) *Query {
+	if offset < 0 {
+		offset = 0
+	}
+	q.offset = offset
+	return q
+}
+
+// AsOf makes the query read the table as it was at a point in time
+// Versions that were removed by the cleanup worker can't be read anymore, see SetHistoryRetention
+func (q *Query) AsOf(t time.Time) *Query {
+	if q.err != nil {
+		return q
+	}
+
+	if t.IsZero() {
+		q.err = NewResponse(StatusBadRequest, "AsOf needs a point in time")
+		return q
+	}
+
+	q.asOf = t.UnixNano()
+	return q
+}
+
+// GetAll runs the query and returns all matching records
+// Ref values are not loaded into the records, read them with Record.ReadRefData or Record.OpenRef
+func (q *Query) GetAll() ([]*Record, error) {
+	defer q.forgetRefValues()
+	release := q.pin()
+	defer release()
+
+	records, err := q.matching()
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.sortRecords(records)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply offset and limit
+	if q.offset >= len(records) {
+		return []*Record{}, nil
+	}
+	records = records[q.offset:]
+	if q.limit >= 0 && q.limit < len(records) {
+		records = records[:q.limit]
+	}
+
+	return records, nil
+}
+
+// First runs the query and returns the first matching record
+func (q *Query) First() (*Record, error) {
+	limit := q.limit
+	q.limit = 1
+	records, err := q.GetAll()
+	q.limit = limit
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, NewResponse(StatusRecordNotFound, "Record not found")
+	}
+
+	return records[0], nil
+}
+
+// Count returns the number of matching records, Limit and Offset are ignored
+func (q *Query) Count() (int, error) {
+	defer q.forgetRefValues()
+	release := q.pin()
+	defer release()
+
+	records, err := q.matching()
+	if err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// lookupField finds a field of the queried table and sets the query error if it doesn't exist
+func (q *Query) lookupField(name string) (Field, bool) {
+	for _, f := range q.table.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	q.err = NewResponse(StatusFieldDoesntExist, "Field "+name+" does not exist in table "+q.table.TableName)
+	return Field{}, false
+}
+
+// matching returns all current records that match every condition
+func (q *Query) matching() ([]*Record, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	var records []*Record
+	var err error
+	if q.asOf != 0 {
+		// Indexes don't know which version was current at a point in time, so the whole table is read
+		records, err = q.table.readAllRecords()
+		if err == nil {
+			records = versionsAt(records, q.asOf)
+		}
+	} else {
+		records, err = q.candidates()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Changes staged in the transaction replace the stored versions of their rows
+	staged := make(map[int64]*Record)
+	if q.tx != nil {
+		for _, record := range q.tx.stagedRows(q.table) {
+			staged[record.RowKey] = record
+		}
+
+		var visible []*Record
+		for _, record := range records {
+			if staged[record.RowKey] == nil {
+				visible = append(visible, record)
+			}
+		}
+		records = append(visible, q.tx.stagedRows(q.table)...)
+	}
+
+	var result []*Record
+	for _, record := range records {
+		// Staged versions are not current until they are committed
+		current := record.Metadata.IsCurrent || staged[record.RowKey] == record
+		if !current || record.Metadata.IsDeleted {
+			continue
+		}
+
+		ok, err := q.matches(record)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result = append(result, record)
+		}
+	}
+
+	return result, nil
+}
+
+// candidates returns the records that have to be checked against the conditions
+// The first condition that can use an index narrows the records down, otherwise the whole table is read
+func (q *Query) candidates() ([]*Record, error) {
+	for _, c := range q.conditions {
+		positions, ok, err := q.tm.indexCandidates(q.table, c)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return q.tm.recordsAt(q.table, positions)
+		}
+	}
+
+	return q.table.readAllRecords()
+}
+
+// matches checks a record against all conditions of the query
+func (q *Query) matches(record *Record) (bool, error) {
+	for _, c := range q.conditions {
+		// Ref values are only read as far as the comparison needs
+		if want, ok := c.value.(string); ok && c.field.Type == "ref" && !fieldIsNull(record, c.field) {
+			cmp, err := q.compareRef(record, c.field, want)
+			if err != nil {
+				return false, err
+			}
+			if !operatorMatches(c.operator, cmp) {
+				return false, nil
+			}
+			continue
+		}
+
+		value, isNull, err := q.fieldValue(record, c.field)
+		if err != nil {
+			return false, err
+		}
+
+		// Null only matches = nil and != anything that is not nil
+		if isNull || c.value == nil {
+			switch c.operator {
+			case "=", "==":
+				if isNull != (c.value == nil) {
+					return false, nil
+				}
+			case "!=":
+				if isNull == (c.value == nil) {
+					return false, nil
+				}
+			default:
+				return false, nil
+			}
+			continue
+		}
+
+		cmp, err := compareValues(c.field, value, c.value)
+		if err != nil {
+			return false, err
+		}
+
+		if !operatorMatches(c.operator, cmp) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// fieldIsNull checks if a field of a record is null without reading its value
+func fieldIsNull(record *Record, field Field) bool {
+	meta, exists := record.FieldsMeta[field.Name]
+	return !exists || meta.IsNull
+}
+
+// compareRef compares a ref value with a string, at most one byte more than the string is read
+func (q *Query) compareRef(record *Record, field Field, want string) (int, error) {
+	// Values of staged records are still in the record
+	if value, ok := record.FieldsData[field.Name].(string); ok {
+		return strings.Compare(value, want), nil
+	}
+
+	ref, err := record.openRefFile(q.table.SchemaPath, q.table.TableName, field.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer ref.Close()
+
+	prefix, err := io.ReadAll(io.LimitReader(ref, int64(len(want))+1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read field '%s': %v", field.Name, err)
+	}
+	return strings.Compare(string(prefix), want), nil
+}
+
+// pin makes the query read all files in the generation the table has when the query starts
+// The returned function releases the files once the query is done
+func (q *Query) pin() func() {
+	table, release := q.tm.pin(q.table)
+	q.table = table
+	return release
+}
+
+// forgetRefValues drops the ref values read while the query ran
+func (q *Query) forgetRefValues() {
+	q.refValues = nil
+}
+
+// fieldValue returns the value of a field, ref fields are read from their data file once per query run
+func (q *Query) fieldValue(record *Record, field Field) (interface{}, bool, error) {
+	if fieldIsNull(record, field) {
+		return nil, true, nil
+	}
+
+	if field.Type == "ref" {
+		if value, exists := record.FieldsData[field.Name]; exists {
+			return value, false, nil
+		}
+
+		key := refValueKey{record: record, field: field.Name}
+		if value, exists := q.refValues[key]; exists {
+			return value, false, nil
+		}
+		value, err := record.ReadRefData(q.table.SchemaPath, q.table.TableName, field.Name)
+		if err != nil {
+			return nil, false, err
+		}
+		if q.refValues == nil {
+			q.refValues = make(map[refValueKey]string)
+		}
+		q.refValues[key] = value
+		return value, false, nil
+	}
+
+	// Blob values are not read, it is enough to know they are set
+	if field.Type == Blob {
+		return nil, false, nil
+	}
+
+	value, exists := record.FieldsData[field.Name]
+	if !exists || value == nil {
+		return nil, true, nil
+	}
+	return value, false, nil
+}
+
+// sortRecords sorts the records by all sort orders of the query
+// Values that can't be read or compared end the sort, the first error is returned
+func (q *Query) sortRecords(records []*Record) error {
+	if len(q.sorts) == 0 {
+		return nil
+	}
+
+	var sortErr error
+	sort.SliceStable(records, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+
+		for _, s := range q.sorts {
+			a, aNull, err := q.fieldValue(records[i], s.field)
+			if err != nil {
+				sortErr = err
+				return false
+			}
+			b, bNull, err := q.fieldValue(records[j], s.field)
+			if err != nil {
+				sortErr = err
+				return false
+			}
+
+			// Nulls are sorted before any value
+			var cmp int
+			switch {
+			case aNull && bNull:
+				cmp = 0
+			case aNull:
+				cmp = -1
+			case bNull:
+				cmp = 1
+			default:
+				var err error
+				cmp, err = compareValues(s.field, a, b)
+				if err != nil {
+					sortErr = err
+					return false
+				}
+			}
+
+			if cmp == 0 {
+				continue
+			}
+			if s.ascending {
+				return cmp < 0
+			}
+			return cmp > 0
+		}
+		return false
+	})
+
+	return sortErr
+}
+
+// operatorMatches checks the result of a comparison against an operator
+func operatorMatches(operator string, cmp int) bool {
+	switch operator {
+	case "=", "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareValues compares two values of a field and returns -1, 0 or 1
+func compareValues(field Field, a, b interface{}) (int, error) {
+	switch field.Type {
+	case Int, TimeID, Serial:
+		// Compare as integers if possible so big int64 values stay exact
+		if cmp, ok := compareIntegers(a, b); ok {
+			return cmp, nil
+		}
+		fx, okA := toFloat64(a)
+		fy, okB := toFloat64(b)
+		if okA && okB {
+			return compareOrdered(fx, fy), nil
+		}
+	case Float:
+		x, okA := toFloat64(a)
+		y, okB := toFloat64(b)
+		if okA && okB {
+			return compareOrdered(x, y), nil
+		}
+	case UUID:
+		x, okA := normalizeUUID(a)
+		y, okB := normalizeUUID(b)
+		if okA && okB {
+			return strings.Compare(x, y), nil
+		}
+	case String, "ref":
+		x, okA := a.(string)
+		y, okB := b.(string)
+		if okA && okB {
+			return strings.Compare(x, y), nil
+		}
+	case Bool:
+		x, okA := a.(bool)
+		y, okB := b.(bool)
+		if okA && okB {
+			switch {
+			case x == y:
+				return 0, nil
+			case !x:
+				return -1, nil
+			default:
+				return 1, nil
+			}
+		}
+	case Decimal:
+		if cmp, ok := compareDecimals(a, b); ok {
+			return cmp, nil
+		}
+	case Date, Timestamp, Duration:
+		x, okA := timeFieldToInt64(field, a)
+		y, okB := timeFieldToInt64(field, b)
+		if okA && okB {
+			return compareOrdered(x, y), nil
+		}
+	default:
+		return 0, fmt.Errorf("field '%s' has unsupported type '%s'", field.Name, field.Type)
+	}
+
+	return 0, NewResponse(StatusBadRequest, fmt.Sprintf("Can't compare field '%s' of type '%s' with %T", field.Name, field.Type, b))
+}
+
+// compareIntegers compares two values of any integer types exactly
+// Unsigned values above the int64 range are larger than every int64 value
+func compareIntegers(a, b interface{}) (int, bool) {
+	x, okA := toInt64(a)
+	y, okB := toInt64(b)
+	bigA, isBigA := bigUnsigned(a)
+	bigB, isBigB := bigUnsigned(b)
+
+	switch {
+	case okA && okB:
+		return compareOrdered(x, y), true
+	case isBigA && isBigB:
+		return compareOrdered(bigA, bigB), true
+	case isBigA && okB:
+		return 1, true
+	case okA && isBigB:
+		return -1, true
+	}
+	return 0, false
+}
+
+// bigUnsigned returns unsigned values that are above the int64 range
+func bigUnsigned(v interface{}) (uint64, bool) {
+	var n uint64
+	switch u := v.(type) {
+	case uint:
+		n = uint64(u)
+	case uint64:
+		n = u
+	default:
+		return 0, false
+	}
+	return n, n > math.MaxInt64
+}
+
+// compareOrdered compares two ordered values
+func compareOrdered[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// toInt64 converts any integer type to an int64
+// Unsigned values above the int64 range can't be converted
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		if uint64(n) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// toFloat64 converts any number type to a float64
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	if i, ok := toInt64(v); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
@@ -0,0 +1,61 @@
+package htdb
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+func TestWhereComparesUnsignedValuesAboveTheIntRange(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	for _, n := range []int64{math.MinInt64, -1, math.MaxInt64} {
+		if _, err := tm.InsertRecord(table, map[string]interface{}{"n": n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	big := uint64(math.MaxInt64) + 1
+	tests := []struct {
+		operator string
+		want     int
+	}{{"<", 3}, {"<=", 3}, {"=", 0}, {"!=", 3}, {">", 0}, {">=", 0}}
+	check := func() {
+		t.Helper()
+		for _, test := range tests {
+			count, err := tm.Select(table).Where("n", test.operator, big).Count()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != test.want {
+				t.Fatalf("n %s %d matches %d records, want %d", test.operator, big, count, test.want)
+			}
+		}
+	}
+	check()
+
+	// Index keys are signed, the value can't be looked up in the index
+	if err := tm.CreateIndex(table, "n"); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestSortReturnsErrorsOfUnreadableValues(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "text", Type: "ref", Length: 128}})
+	for _, text := range []string{"b", "a"} {
+		if _, err := tm.InsertRecord(table, map[string]interface{}{"text": text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Remove(table.refPath("text")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.Select(table).Sort("text", true).GetAll(); err == nil {
+		t.Fatal("records were sorted by values that could not be read")
+	}
+}
@@ -6,16 +6,21 @@
 package htdb
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
 // RecordMetadata contains the metadata for a record
 type RecordMetadata struct {
-	IsCurrent     bool   `json:"is_current"`     // true if this record is the latest version
+	IsCurrent     bool   `json:"is_current"`     // true if this record is the latest version of its row, resolved when reading
 	IsDeleted     bool   `json:"is_deleted"`     // true if the record was explicitly deleted
 	IsLocked      bool   `json:"is_locked"`      // true if the record is locked by a transaction
 	TransactionID uint64 `json:"transaction_id"` // The transaction ID currently owning this record
@@ -28,18 +33,40 @@ type FieldMetadata struct {
 
 // Record represents a record in a table
 type Record struct {
-	ID         int64                    `json:"id"`          // Primary key (timeID)
+	ID         int64                    `json:"id"`          // ID of this version (timeID)
 	Metadata   RecordMetadata           `json:"metadata"`    // Record metadata
 	FieldsData map[string]interface{}   `json:"fields_data"` // Field values
 	FieldsMeta map[string]FieldMetadata `json:"fields_meta"` // Field metadata
 	RefOffsets map[string][2]int64      `json:"ref_offsets"` // Offsets for ref fields [start, end]
+	PrevID     int64                    `json:"prev_id"`     // ID of the version this record replaces, 0 for new records
+	RowKey     int64                    `json:"row_key"`     // Logical identity of the row, the same for all of its versions
+	generation int                      // Generation of the table files the record was read from, RefOffsets point into them
 	mu         sync.Mutex               // Mutex for concurrent access
 }
 
+// Size of the record header in the table file
+const (
+	recordHeaderSizeV1 = 12 // 8 bytes ID, 4 bytes metadata
+	recordHeaderSizeV2 = 20 // 8 bytes ID, 4 bytes metadata, 8 bytes PrevID
+	recordHeaderSize   = 28 // 8 bytes ID, 4 bytes metadata, 8 bytes PrevID, 8 bytes RowKey
+)
+
+// headerSizeFor returns the size of the record header in a table format version
+func headerSizeFor(formatVersion int) int {
+	switch {
+	case formatVersion < 2:
+		return recordHeaderSizeV1
+	case formatVersion < 3:
+		return recordHeaderSizeV2
+	}
+	return recordHeaderSize
+}
+
 // NewRecord creates a new record with default metadata
 func NewRecord(id int64, data map[string]interface{}) *Record {
 	record := &Record{
-		ID: id,
+		ID:     id,
+		RowKey: id, // The first version names the row
 		Metadata: RecordMetadata{
 			IsCurrent:     true,
 			IsDeleted:     false,
@@ -51,7 +78,7 @@ func NewRecord(id int64, data map[string]interface{}) *Record {
 		RefOffsets: make(map[string][2]int64),
 	}
 
-	// Add ID to FieldsData
+	// Add the row key to FieldsData
 	record.FieldsData["id"] = id
 	record.FieldsMeta["id"] = FieldMetadata{IsNull: false}
 
@@ -124,6 +151,9 @@ func (r *Record) Clone(transactionID uint64) (*Record, error) {
 		FieldsData: make(map[string]interface{}),
 		FieldsMeta: make(map[string]FieldMetadata),
 		RefOffsets: make(map[string][2]int64),
+		PrevID:     r.ID,
+		RowKey:     r.RowKey,
+		generation: r.generation,
 	}
 
 	// Copy data
@@ -131,8 +161,8 @@ func (r *Record) Clone(transactionID uint64) (*Record, error) {
 		clone.FieldsData[k] = v
 	}
 
-	// Update ID in FieldsData to match the new ID
-	clone.FieldsData["id"] = newID
+	// The id field is the row key, so it stays the same for all versions
+	clone.FieldsData["id"] = r.RowKey
 
 	// Copy metadata
 	for k, v := range r.FieldsMeta {
@@ -153,8 +183,7 @@ func (r *Record) Clone(transactionID uint64) (*Record, error) {
 // Serialize serializes the record to binary format
 func (r *Record) Serialize(fields []Field) ([]byte, error) {
 	// Calculate the size of the record
-	recordSize := 8 // ID (int64)
-	recordSize += 4 // Metadata (4 bytes for booleans and transaction ID)
+	recordSize := recordHeaderSize // ID, metadata, PrevID and RowKey
 
 	// Add field sizes
 	for _, field := range fields {
@@ -193,6 +222,14 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 	data[offset] = byte(r.Metadata.TransactionID >> 16)
 	offset++
 
+	// Write the ID of the replaced version
+	binary.LittleEndian.PutUint64(data[offset:offset+8], uint64(r.PrevID))
+	offset += 8
+
+	// Write the row key
+	binary.LittleEndian.PutUint64(data[offset:offset+8], uint64(r.RowKey))
+	offset += 8
+
 	// Write fields
 	for _, field := range fields {
 		if field.Name == "id" {
@@ -211,16 +248,16 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 		}
 		offset++
 
-		// Write field data
+		// Write field data, ref fields only need their offsets
 		value, exists := r.FieldsData[field.Name]
-		if !exists || fieldMeta.IsNull {
+		if fieldMeta.IsNull || (!exists && !isRefField(field)) {
 			// Write zeros for null fields
 			offset += int(field.Length)
 			continue
 		}
 
 		switch field.Type {
-		case TimeID:
+		case TimeID, Serial:
 			v, ok := value.(int64)
 			if !ok {
 				return nil, fmt.Errorf("field '%s' requires an int64 value", field.Name)
@@ -242,14 +279,43 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 			if !ok {
 				return nil, fmt.Errorf("field '%s' requires a float64 value", field.Name)
 			}
-			binary.LittleEndian.PutUint64(data[offset:offset+int(field.Length)], uint64(v))
+			binary.LittleEndian.PutUint64(data[offset:offset+int(field.Length)], math.Float64bits(v))
 		case String:
 			v, ok := value.(string)
 			if !ok {
 				return nil, fmt.Errorf("field '%s' requires a string value", field.Name)
 			}
 			copy(data[offset:offset+int(field.Length)], v)
-		case "ref":
+		case Bool:
+			v, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("field '%s' requires a bool value", field.Name)
+			}
+			if v {
+				data[offset] = 1
+			}
+		case UUID:
+			v, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("field '%s' requires a uuid string value", field.Name)
+			}
+			u, ok := parseUUID(v)
+			if !ok {
+				return nil, fmt.Errorf("field '%s' has an invalid uuid '%s'", field.Name, v)
+			}
+			copy(data[offset:offset+int(field.Length)], u)
+		case Decimal:
+			err := putDecimal(data[offset:offset+int(field.Length)], field, value)
+			if err != nil {
+				return nil, err
+			}
+		case Date, Timestamp, Duration:
+			v, ok := timeFieldToInt64(field, value)
+			if !ok {
+				return nil, fmt.Errorf("field '%s' requires a %s value", field.Name, timeGoType(field))
+			}
+			binary.LittleEndian.PutUint64(data[offset:offset+int(field.Length)], uint64(v))
+		case "ref", Blob:
 			// For ref fields, we store the offsets
 			offsets, ok := r.RefOffsets[field.Name]
 			if !ok {
@@ -269,7 +335,12 @@ func (r *Record) Serialize(fields []Field) ([]byte, error) {
 
 // Deserialize deserializes binary data into a record
 func DeserializeRecord(data []byte, fields []Field) (*Record, error) {
-	if len(data) < 12 { // Minimum size: 8 (ID) + 4 (metadata)
+	return deserializeRecord(data, fields, tableFormatVersion)
+}
+
+// deserializeRecord deserializes a record that was written in the given table format version
+func deserializeRecord(data []byte, fields []Field, formatVersion int) (*Record, error) {
+	if len(data) < headerSizeFor(formatVersion) {
 		return nil, fmt.Errorf("data too short to be a valid record")
 	}
 
@@ -299,10 +370,23 @@ func DeserializeRecord(data []byte, fields []Field) (*Record, error) {
 	record.Metadata.TransactionID = txID
 	offset++
 
+	// Read the ID of the replaced version
+	if formatVersion >= 2 {
+		record.PrevID = int64(binary.LittleEndian.Uint64(data[offset : offset+8]))
+		offset += 8
+	}
+
+	// Read the row key, older formats have no rows and every version stands for itself
+	record.RowKey = record.ID
+	if formatVersion >= 3 {
+		record.RowKey = int64(binary.LittleEndian.Uint64(data[offset : offset+8]))
+		offset += 8
+	}
+
 	// Read fields
 	for _, field := range fields {
 		if field.Name == "id" {
-			record.FieldsData["id"] = record.ID
+			record.FieldsData["id"] = record.RowKey
 			record.FieldsMeta["id"] = FieldMetadata{IsNull: false}
 			continue
 		}
@@ -320,17 +404,31 @@ func DeserializeRecord(data []byte, fields []Field) (*Record, error) {
 
 		// Read field data
 		switch field.Type {
-		case TimeID, Int:
+		case TimeID, Int, Serial:
 			value := int64(binary.LittleEndian.Uint64(data[offset : offset+int(field.Length)]))
 			record.FieldsData[field.Name] = value
 		case Float:
 			bits := binary.LittleEndian.Uint64(data[offset : offset+int(field.Length)])
-			record.FieldsData[field.Name] = float64(bits)
+			if formatVersion < 4 {
+				// Older versions stored the value cut to an integer
+				record.FieldsData[field.Name] = float64(bits)
+			} else {
+				record.FieldsData[field.Name] = math.Float64frombits(bits)
+			}
 		case String:
 			str := string(data[offset : offset+int(field.Length)])
 			// Trim null bytes
-			record.FieldsData[field.Name] = string([]byte(str))
-		case "ref":
+			record.FieldsData[field.Name] = strings.TrimRight(str, "\x00")
+		case Bool:
+			record.FieldsData[field.Name] = data[offset] != 0
+		case UUID:
+			record.FieldsData[field.Name] = formatUUID(data[offset : offset+int(field.Length)])
+		case Decimal:
+			record.FieldsData[field.Name] = readDecimal(data[offset:offset+int(field.Length)], field)
+		case Date, Timestamp, Duration:
+			value := int64(binary.LittleEndian.Uint64(data[offset : offset+int(field.Length)]))
+			record.FieldsData[field.Name] = timeFieldFromInt64(field, value)
+		case "ref", Blob:
 			start := int64(binary.LittleEndian.Uint64(data[offset : offset+8]))
 			end := int64(binary.LittleEndian.Uint64(data[offset+8 : offset+16]))
 			record.RefOffsets[field.Name] = [2]int64{start, end}
@@ -343,8 +441,33 @@ func DeserializeRecord(data []byte, fields []Field) (*Record, error) {
 }
 
 // WriteRefData writes data for a ref field to the appropriate file
+// The value is compressed and deduplicated as the field is configured, fields the catalog doesn't know are written as they are
 func (r *Record) WriteRefData(schema, tableName, fieldName string, value string) error {
-	refFilePath := fmt.Sprintf("%s/%s.%s.data%s", schema, tableName, fieldName, fileEnding)
+	catalog, err := readCatalog(schema)
+	if err != nil {
+		return err
+	}
+
+	field := Field{Name: fieldName, Type: "ref"}
+	if table, exists := catalog.Tables[tableName]; exists {
+		if configured, exists := table.getField(fieldName); exists {
+			field = configured
+		}
+	}
+	return r.writeRefStream(schema, tableName, field, strings.NewReader(value))
+}
+
+// writeRefStream appends everything read from src to the data file of a ref or blob field
+// The value is written behind its header byte, compressed as the field says. Values of dedup fields are hashed
+// while they are written and share the offsets of a stored value with the same content
+func (r *Record) writeRefStream(schema, tableName string, field Field, src io.Reader) error {
+	fieldName := field.Name
+	refFilePath := refDataPath(schema, tableName, fieldName, r.generation)
+
+	// Appends to other data files don't wait for this one
+	state := refState(refFilePath)
+	state.mu.Lock()
+	defer state.mu.Unlock()
 
 	refFile, err := os.OpenFile(refFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
@@ -360,38 +483,185 @@ func (r *Record) WriteRefData(schema, tableName, fieldName string, value string)
 
 	start := stat.Size()
 
+	hash := sha256.New()
+	if field.Dedup {
+		src = io.TeeReader(src, hash)
+	}
+
 	// Write the data
-	_, err = refFile.Write([]byte(value))
+	end, err := writeRefValue(refFile, refCodecs[field.Compression], src)
 	if err != nil {
+		// Cut off the partly written value, nothing refers to it
+		refFile.Truncate(start)
 		return fmt.Errorf("failed to write to ref field file: %v", err)
 	}
 
+	offsets := [2]int64{start, end}
+	if field.Dedup {
+		var sum [sha256.Size]byte
+		copy(sum[:], hash.Sum(nil))
+		offsets, err = dedupRefValue(state, refFile, refFilePath, sum, offsets)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Store the offsets
-	r.RefOffsets[fieldName] = [2]int64{start, start + int64(len(value))}
+	r.RefOffsets[fieldName] = offsets
 
 	return nil
 }
 
 // ReadRefData reads data for a ref field from the appropriate file
+// Only the bytes of the value are read, use OpenRef to read large values in parts
 func (r *Record) ReadRefData(schema, tableName, fieldName string) (string, error) {
+	value, err := r.openRefFile(schema, tableName, fieldName)
+	if err != nil {
+		return "", err
+	}
+	defer value.Close()
+
+	data, err := io.ReadAll(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to read field '%s': %v", fieldName, err)
+	}
+	return string(data), nil
+}
+
+// OpenRef opens the value of a ref or blob field for reading, the value is read from the data file as it is consumed
+// Seeking in a compressed value decompresses it up to the new position. The returned reader has to be closed
+func (r *Record) OpenRef(table *Table, fieldName string) (io.ReadSeekCloser, error) {
+	field, exists := table.getField(fieldName)
+	if !exists {
+		return nil, fmt.Errorf("field '%s' does not exist in table '%s'", fieldName, table.TableName)
+	}
+	if !isRefField(field) {
+		return nil, fmt.Errorf("field '%s' is not a ref or blob field", fieldName)
+	}
+
+	if meta, exists := r.FieldsMeta[fieldName]; exists && meta.IsNull {
+		return nil, fmt.Errorf("field '%s' is null", fieldName)
+	}
+
+	return r.openRefFile(table.SchemaPath, table.TableName, fieldName)
+}
+
+// openRefFile opens the stored value of a ref or blob field at the offsets of the record
+func (r *Record) openRefFile(schema, tableName, fieldName string) (io.ReadSeekCloser, error) {
 	offsets, exists := r.RefOffsets[fieldName]
 	if !exists {
-		return "", fmt.Errorf("no ref offsets found for field '%s'", fieldName)
+		return nil, fmt.Errorf("no ref offsets found for field '%s'", fieldName)
 	}
 
-	refFilePath := fmt.Sprintf("%s/%s.%s.data%s", schema, tableName, fieldName, fileEnding)
+	// The offsets point into the data file of the generation the record was read from
+	refFilePath := refDataPath(schema, tableName, fieldName, r.generation)
+
+	file, err := os.Open(refFilePath)
+	if os.IsNotExist(err) && r.generation > 0 {
+		return nil, tableCompacted(tableName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ref field file: %v", err)
+	}
 
-	// Read the file
-	data, err := os.ReadFile(refFilePath)
+	stat, err := file.Stat()
 	if err != nil {
-		return "", fmt.Errorf("failed to read ref field file: %v", err)
+		file.Close()
+		return nil, fmt.Errorf("failed to get file stats: %v", err)
 	}
 
 	// Check bounds
-	if offsets[0] < 0 || offsets[1] > int64(len(data)) || offsets[0] > offsets[1] {
-		return "", fmt.Errorf("invalid ref offsets for field '%s'", fieldName)
+	if offsets[0] < 0 || offsets[1] > stat.Size() || offsets[0] > offsets[1] {
+		file.Close()
+		return nil, fmt.Errorf("invalid ref offsets for field '%s'", fieldName)
+	}
+
+	value, err := openRefValue(io.NewSectionReader(file, offsets[0], offsets[1]-offsets[0]), file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open field '%s': %v", fieldName, err)
+	}
+	return value, nil
+}
+
+// writeRefValue writes the header byte and the compressed value to the data file and returns the new end of the file
+func writeRefValue(refFile *os.File, codec byte, src io.Reader) (int64, error) {
+	_, err := refFile.Write([]byte{codec})
+	if err != nil {
+		return 0, err
+	}
+
+	encoder, err := newRefEncoder(refFile, codec)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(encoder, src)
+	if err != nil {
+		encoder.Close()
+		return 0, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	stat, err := refFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// blobSource returns a reader for a validated blob value
+func blobSource(value interface{}) io.Reader {
+	if data, ok := value.([]byte); ok {
+		return bytes.NewReader(data)
+	}
+	return value.(io.Reader)
+}
+
+// blobReader is an uncompressed ref or blob value opened for reading, closing it closes the data file
+type blobReader struct {
+	*io.SectionReader
+	file io.Closer
+}
+
+// Close closes the data file of the blob
+func (b *blobReader) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Close()
+}
+
+// OpenBlob opens the value of a blob field for reading, the value is read from the data file as it is consumed
+// The returned reader also implements io.Seeker and has to be closed, see OpenRef
+func (r *Record) OpenBlob(schema, tableName, fieldName string) (io.ReadCloser, error) {
+	if meta, exists := r.FieldsMeta[fieldName]; exists && meta.IsNull {
+		return nil, fmt.Errorf("field '%s' is null", fieldName)
+	}
+
+	return r.openRefFile(schema, tableName, fieldName)
+}
+
+// CopyBlob writes the value of a blob field to w and returns the number of bytes written
+func (r *Record) CopyBlob(schema, tableName, fieldName string, w io.Writer) (int64, error) {
+	blob, err := r.OpenBlob(schema, tableName, fieldName)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+
+	return io.Copy(w, blob)
+}
+
+// ReadBlob reads the whole value of a blob field, use OpenBlob or CopyBlob for large values
+func (r *Record) ReadBlob(schema, tableName, fieldName string) ([]byte, error) {
+	blob, err := r.OpenBlob(schema, tableName, fieldName)
+	if err != nil {
+		return nil, err
 	}
+	defer blob.Close()
 
-	// Extract the data
-	return string(data[offsets[0]:offsets[1]]), nil
+	return io.ReadAll(blob)
 }
@@ -0,0 +1,161 @@
+package htdb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteRefDataUsesTheFieldConfiguration(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	table := createTestTable(t, db, "a", []Field{{Name: "text", Type: "ref", Length: 128, Dedup: true, Compression: "zstd"}})
+
+	first := &Record{RefOffsets: make(map[string][2]int64)}
+	second := &Record{RefOffsets: make(map[string][2]int64)}
+	for _, record := range []*Record{first, second} {
+		if err := record.WriteRefData(table.SchemaPath, table.TableName, "text", "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.RefOffsets["text"] != second.RefOffsets["text"] {
+		t.Fatalf("equal values of a dedup field are stored at %v and %v", first.RefOffsets["text"], second.RefOffsets["text"])
+	}
+
+	data, err := os.ReadFile(table.refPath("text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec := data[first.RefOffsets["text"][0]]; codec != refCodecZstd {
+		t.Fatalf("value is stored with compression %d, want %d", codec, refCodecZstd)
+	}
+	if text, err := first.ReadRefData(table.SchemaPath, table.TableName, "text"); err != nil || text != "hello" {
+		t.Fatalf("expected 'hello', got %q (%v)", text, err)
+	}
+}
+
+func TestBoolFieldsUseOneByte(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "flag", Type: Bool}})
+	field, _ := table.getField("flag")
+	if field.Length != 1 {
+		t.Fatalf("bool field got a length of %d bytes, want 1", field.Length)
+	}
+
+	schema, err := db.Schema("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := schema.CreateTable("b", []Field{{Name: "flag", Type: Bool, Length: 2}}); response.StatusCode == 200 {
+		t.Fatal("a bool field with a length of 2 bytes was created")
+	}
+
+	for _, flag := range []bool{true, false, true} {
+		if _, err := tm.InsertRecord(table, map[string]interface{}{"flag": flag}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := tm.Select(table).Where("flag", "=", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].FieldsData["flag"] != true {
+		t.Fatalf("flag = true matches %d records", len(records))
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"flag": 1}); err == nil {
+		t.Fatal("an int was stored in a bool field")
+	}
+}
+
+func TestBlobFieldsStoreBinaryValues(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "n", Type: Int, Length: 8},
+		{Name: "data", Type: Blob, Length: 16},
+	})
+
+	small := []byte{0, 1, 2, 0, 255}
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"n": 1, "data": small}); err != nil {
+		t.Fatal(err)
+	}
+	// Readers are streamed into the data file
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"n": 2, "data": bytes.NewReader(large)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := tm.Select(table).Sort("n", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := records[0].ReadBlob(table.SchemaPath, table.TableName, "data")
+	if err != nil || !bytes.Equal(data, small) {
+		t.Fatalf("expected %v, got %v (%v)", small, data, err)
+	}
+	var copied bytes.Buffer
+	n, err := records[1].CopyBlob(table.SchemaPath, table.TableName, "data", &copied)
+	if err != nil || n != int64(len(large)) || !bytes.Equal(copied.Bytes(), large) {
+		t.Fatalf("copied %d bytes (%v), want the %d bytes that were stored", n, err, len(large))
+	}
+	if _, err := records[2].OpenBlob(table.SchemaPath, table.TableName, "data"); err == nil {
+		t.Fatal("a blob that was never set was opened")
+	}
+
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"n": 4, "data": "text"}); err == nil {
+		t.Fatal("a string was stored in a blob field")
+	}
+}
+
+func TestOpenRefReadsRangesOfAValue(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "plain", Type: "ref", Length: 128},
+		{Name: "packed", Type: "ref", Length: 128, Compression: "zstd"},
+	})
+	value := strings.Repeat("0123456789", 1000)
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"plain": value, "packed": value}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries don't load ref values into the records
+	record, err := tm.Select(table).Where("plain", "=", value).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, loaded := record.FieldsData["plain"]; loaded {
+		t.Fatal("query loaded the ref value into the record")
+	}
+
+	for _, field := range []string{"plain", "packed"} {
+		ref, err := record.OpenRef(table, field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part := make([]byte, 5)
+		if _, err := ref.Seek(4321, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(ref, part); err != nil || string(part) != "12345" {
+			t.Fatalf("%s: read %q (%v) at 4321, want \"12345\"", field, part, err)
+		}
+		if end, err := ref.Seek(-3, io.SeekEnd); err != nil || end != int64(len(value))-3 {
+			t.Fatalf("%s: seek to the end returned %d (%v)", field, end, err)
+		}
+		rest, err := io.ReadAll(ref)
+		if err != nil || string(rest) != "789" {
+			t.Fatalf("%s: read %q (%v) at the end, want \"789\"", field, rest, err)
+		}
+		ref.Close()
+	}
+
+	if _, err := record.OpenRef(table, "id"); err == nil {
+		t.Fatal("a field that is not a ref field was opened")
+	}
+}
@@ -0,0 +1,279 @@
+// RefCompression.go
+// Description: Compression of ref and blob field values for the HTDB library
+// Every stored value starts with a header byte that names its compression, the offsets of a record cover the header
+// and the compressed bytes. Changing the compression of a field only affects values written afterwards
+// Author: harto.dev
+
+package htdb
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Header bytes of stored ref and blob values
+const (
+	refCodecNone byte = 0
+	refCodecGzip byte = 1
+	refCodecZstd byte = 2
+)
+
+// refCodecs maps the compression setting of a field to the header byte of its values
+var refCodecs = map[string]byte{
+	"":     refCodecNone,
+	"none": refCodecNone,
+	"gzip": refCodecGzip,
+	"zstd": refCodecZstd,
+}
+
+// validateCompression checks the compression setting of a field
+func validateCompression(f Field) error {
+	if _, known := refCodecs[f.Compression]; !known {
+		return fmt.Errorf("field '%s' has unknown compression '%s', use 'zstd', 'gzip' or 'none'", f.Name, f.Compression)
+	}
+	if f.Compression != "" && f.Compression != "none" && !isRefField(f) {
+		return fmt.Errorf("field '%s' of type '%s' can't be compressed, only ref and blob fields can", f.Name, f.Type)
+	}
+	return nil
+}
+
+// nopWriteCloser passes writes through for values that are stored uncompressed
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newRefEncoder returns a writer that compresses a value into w, it has to be closed to flush the value
+func newRefEncoder(w io.Writer, codec byte) (io.WriteCloser, error) {
+	switch codec {
+	case refCodecGzip:
+		return gzip.NewWriter(w), nil
+	case refCodecZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// decodedBlobReader is a compressed value opened for reading, closing it releases the decoder and closes the data file
+// Seeking decompresses the value up to the new position, seeking backwards starts again at the beginning
+type decodedBlobReader struct {
+	stored  *io.SectionReader // Compressed bytes of the value after the header byte
+	codec   byte
+	decoder io.Reader
+	release func()
+	pos     int64 // Position in the decompressed value
+	size    int64 // Size of the decompressed value, -1 until the end was read
+	file    io.Closer
+}
+
+// newRefDecoder returns a reader that decompresses a value
+func newRefDecoder(codec byte, body io.Reader) (io.Reader, func(), error) {
+	switch codec {
+	case refCodecGzip:
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case refCodecZstd:
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return nil, nil, fmt.Errorf("ref value has unknown compression %d", codec)
+}
+
+// rewind starts decompressing the value again from the beginning
+func (d *decodedBlobReader) rewind() error {
+	if d.release != nil {
+		d.release()
+		d.release = nil
+	}
+
+	decoder, release, err := newRefDecoder(d.codec, io.NewSectionReader(d.stored, 0, d.stored.Size()))
+	if err != nil {
+		return fmt.Errorf("failed to decompress ref value: %v", err)
+	}
+	d.decoder, d.release, d.pos = decoder, release, 0
+	return nil
+}
+
+// Read decompresses the next part of the value
+func (d *decodedBlobReader) Read(p []byte) (int, error) {
+	n, err := d.decoder.Read(p)
+	d.pos += int64(n)
+	if err == io.EOF {
+		d.size = d.pos
+	}
+	return n, err
+}
+
+// Seek moves to a position in the decompressed value
+func (d *decodedBlobReader) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = d.pos + offset
+	case io.SeekEnd:
+		if d.size < 0 {
+			if _, err := io.Copy(io.Discard, d); err != nil {
+				return 0, fmt.Errorf("failed to decompress ref value: %v", err)
+			}
+		}
+		target = d.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if target < 0 {
+		return 0, fmt.Errorf("negative position %d", target)
+	}
+
+	if target < d.pos {
+		if err := d.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := io.CopyN(io.Discard, d, target-d.pos); err != nil && err != io.EOF {
+		return 0, fmt.Errorf("failed to decompress ref value: %v", err)
+	}
+
+	// Positions after the end are allowed, reading there returns io.EOF
+	d.pos = target
+	return target, nil
+}
+
+// Close releases the decoder and closes the data file
+func (d *decodedBlobReader) Close() error {
+	if d.release != nil {
+		d.release()
+		d.release = nil
+	}
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
+
+// openRefValue returns a reader for the content of a stored value, file is closed with the reader
+// Uncompressed values are read directly from the data file with ReadAt
+func openRefValue(stored *io.SectionReader, file io.Closer) (io.ReadSeekCloser, error) {
+	var header [1]byte
+	if _, err := stored.ReadAt(header[:], 0); err != nil {
+		return nil, fmt.Errorf("ref value has no header")
+	}
+	body := io.NewSectionReader(stored, 1, stored.Size()-1)
+
+	if header[0] == refCodecNone {
+		return &blobReader{SectionReader: body, file: file}, nil
+	}
+
+	d := &decodedBlobReader{stored: body, codec: header[0], size: -1, file: file}
+	if err := d.rewind(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// refValueHash returns the SHA-256 of the content of a stored value, dedup compares contents, not stored bytes
+func refValueHash(stored io.ReaderAt, offsets [2]int64) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	value, err := openRefValue(io.NewSectionReader(stored, offsets[0], offsets[1]-offsets[0]), nil)
+	if err != nil {
+		return sum, err
+	}
+	defer value.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, value)
+	if err != nil {
+		return sum, fmt.Errorf("failed to decompress ref value: %v", err)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// upgradeRefFiles writes the data files of the ref fields with a header byte in front of every value
+// Tables before format version 5 stored values without a header. The new files are written next to the old ones
+// with the .upgrade ending and moved into place with the table file, the offsets of the records are changed to match
+func (t *Table) upgradeRefFiles(records []*Record) error {
+	for _, field := range t.Fields {
+		if !isRefField(field) {
+			continue
+		}
+
+		refFilePath := t.refPath(field.Name)
+		refData, err := os.ReadFile(refFilePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read ref field file: %v", err)
+		}
+
+		var data []byte
+		offsetMap := make(map[[2]int64][2]int64)
+		for _, record := range records {
+			offsets, exists := record.RefOffsets[field.Name]
+			if !exists {
+				continue
+			}
+
+			if newOffsets, processed := offsetMap[offsets]; processed {
+				record.RefOffsets[field.Name] = newOffsets
+				continue
+			}
+
+			// The upgrade stops at a value that is not in the file, the old files are left as they are
+			start, end := offsets[0], offsets[1]
+			if start < 0 || end > int64(len(refData)) || start > end {
+				return fmt.Errorf("record %d has invalid offsets %d-%d for field '%s'", record.ID, start, end, field.Name)
+			}
+
+			newOffsets := [2]int64{int64(len(data)), int64(len(data)) + 1 + end - start}
+			data = append(data, refCodecNone)
+			data = append(data, refData[start:end]...)
+
+			record.RefOffsets[field.Name] = newOffsets
+			offsetMap[offsets] = newOffsets
+		}
+
+		err = writeSyncedFile(refFilePath+".upgrade", data)
+		if err != nil {
+			return fmt.Errorf("failed to write ref field file: %v", err)
+		}
+		if field.Dedup {
+			hashes, err := countedRefHashes(data, field, records)
+			if err != nil {
+				return err
+			}
+			err = writeSyncedFile(refHashPath(refFilePath)+".upgrade", hashes)
+			if err != nil {
+				return fmt.Errorf("failed to write ref hash file: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeSyncedFile writes a file and syncs it before it is used
+func writeSyncedFile(path string, data []byte) error {
+	err := os.WriteFile(path, data, 0644)
+	if err == nil {
+		err = syncFile(path)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
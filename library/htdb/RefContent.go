@@ -0,0 +1,318 @@
+// RefContent.go
+// Description: Content-addressed storage for ref and blob fields of the HTDB library
+// Fields with Dedup set store every distinct value once. The hash file next to the data file lists the
+// SHA-256 of the content of every stored value with its offsets and the number of committed record versions that
+// refer to it, records with the same value share the offsets. Cleanup removes the values that no version refers to
+// Author: harto.dev
+
+package htdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// refContentEntrySize is the size of an entry in the hash file
+const refContentEntrySize = sha256.Size + 24 // hash, start and end offset, reference count
+
+// refContentEntry is a stored value in the content index of a field
+type refContentEntry struct {
+	hash     [sha256.Size]byte
+	offsets  [2]int64
+	count    int64 // Number of committed record versions that refer to the value
+	position int64 // Number of the entry in the hash file
+	verified bool  // Entries read from the hash file are checked against the data file before they are shared
+}
+
+// refFileState is the in-memory state of a ref field data file
+type refFileState struct {
+	mu       sync.Mutex                             // Serializes appends, so the start offset of a value can't be taken by another write
+	entries  []*refContentEntry                     // Entries of the hash file in file order, read on first use
+	contents map[[sha256.Size]byte]*refContentEntry // Content index of a dedup field
+	stored   map[[2]int64]*refContentEntry          // Entries by the offsets of their value, for the reference counts
+}
+
+// refFiles holds the state of every ref field data file by path, guarded by refFilesMu
+var (
+	refFiles   = make(map[string]*refFileState)
+	refFilesMu sync.Mutex
+)
+
+// refState returns the state of a data file, it is created on first use
+func refState(refFilePath string) *refFileState {
+	refFilesMu.Lock()
+	defer refFilesMu.Unlock()
+
+	state, exists := refFiles[refFilePath]
+	if !exists {
+		state = &refFileState{}
+		refFiles[refFilePath] = state
+	}
+	return state
+}
+
+// refHashPath returns the path of the hash file that belongs to a ref field data file
+func refHashPath(refFilePath string) string {
+	return strings.TrimSuffix(refFilePath, ".data"+fileEnding) + ".hash" + fileEnding
+}
+
+// load reads the hash file of a data file the first time the state is used
+// The caller holds s.mu
+func (s *refFileState) load(refFilePath string) error {
+	if s.contents != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(refHashPath(refFilePath))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read ref hash file: %v", err)
+	}
+
+	s.entries = nil
+	s.contents = make(map[[sha256.Size]byte]*refContentEntry)
+	s.stored = make(map[[2]int64]*refContentEntry)
+
+	// A half written entry at the end is left over from a crash and ignored, the next entry is written over it
+	for offset := 0; offset+refContentEntrySize <= len(data); offset += refContentEntrySize {
+		entry := decodeRefHash(data[offset : offset+refContentEntrySize])
+		entry.position = int64(len(s.entries))
+		s.entries = append(s.entries, entry)
+
+		// Values written again after a crash lost them replace the earlier entries
+		s.contents[entry.hash] = entry
+		s.stored[entry.offsets] = entry
+	}
+
+	return nil
+}
+
+// forgetRefContent drops the state of a data file, the content index is read again when the field is written next
+// The caller makes sure that nothing is written to the file at the same time
+func forgetRefContent(refFilePath string) {
+	refFilesMu.Lock()
+	defer refFilesMu.Unlock()
+
+	delete(refFiles, refFilePath)
+}
+
+// dedupRefValue checks if the value just appended at start is stored already
+// If it is, the appended copy is cut off and the offsets of the stored value are returned,
+// otherwise the value is added to the content index. The caller holds state.mu
+func dedupRefValue(state *refFileState, refFile *os.File, refFilePath string, hash [sha256.Size]byte, offsets [2]int64) ([2]int64, error) {
+	err := state.load(refFilePath)
+	if err != nil {
+		return offsets, err
+	}
+
+	if entry, exists := state.contents[hash]; exists {
+		if entry.verified || refRangeMatches(refFilePath, entry.offsets, hash) {
+			entry.verified = true
+			err := refFile.Truncate(offsets[0])
+			if err != nil {
+				return offsets, fmt.Errorf("failed to remove duplicate ref value: %v", err)
+			}
+			return entry.offsets, nil
+		}
+	}
+
+	// New values are not referenced until a commit counts them
+	entry := &refContentEntry{hash: hash, offsets: offsets, position: int64(len(state.entries)), verified: true}
+	err = writeRefHash(refFilePath, entry.position, encodeRefHash(entry))
+	if err != nil {
+		return offsets, err
+	}
+	state.entries = append(state.entries, entry)
+	state.contents[hash] = entry
+	state.stored[offsets] = entry
+
+	return offsets, nil
+}
+
+// refRangeMatches checks that a range of the data file still holds a value with the given hash
+func refRangeMatches(refFilePath string, offsets [2]int64, hash [sha256.Size]byte) bool {
+	refFile, err := os.Open(refFilePath)
+	if err != nil {
+		return false
+	}
+	defer refFile.Close()
+
+	stat, err := refFile.Stat()
+	if err != nil || offsets[0] < 0 || offsets[1] > stat.Size() || offsets[0] > offsets[1] {
+		return false
+	}
+
+	sum, err := refValueHash(refFile, offsets)
+	return err == nil && sum == hash
+}
+
+// writeRefHash writes data at an entry of the hash file of a data file
+func writeRefHash(refFilePath string, position int64, data []byte) error {
+	file, err := os.OpenFile(refHashPath(refFilePath), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open ref hash file: %v", err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteAt(data, position*refContentEntrySize)
+	if err != nil {
+		return fmt.Errorf("failed to write ref hash file: %v", err)
+	}
+	return nil
+}
+
+// countRefValues adds committed record versions to the reference counts of the values of the dedup fields
+// The counts are written and synced before the commit is logged. After a crash a count can be too high but
+// never too low, so no value is removed while a version refers to it. A delta of -1 takes back the counts
+// of a commit that was not logged, fields that were counted already are taken back if a later one fails
+func (t *Table) countRefValues(records []*Record, delta int64) error {
+	var counted []string
+	for _, field := range t.Fields {
+		if !field.Dedup {
+			continue
+		}
+
+		refs := refsOf(records, field.Name, delta)
+		if len(refs) == 0 {
+			continue
+		}
+
+		err := addRefCounts(t.refPath(field.Name), refs)
+		if err != nil {
+			for _, name := range counted {
+				addRefCounts(t.refPath(name), refsOf(records, name, -delta))
+			}
+			return fmt.Errorf("failed to count references to field '%s': %v", field.Name, err)
+		}
+		counted = append(counted, field.Name)
+	}
+	return nil
+}
+
+// refsOf returns how much the count of every value of a field changes for the records
+func refsOf(records []*Record, fieldName string, delta int64) map[[2]int64]int64 {
+	refs := make(map[[2]int64]int64)
+	for _, record := range records {
+		if offsets, exists := record.RefOffsets[fieldName]; exists {
+			refs[offsets] += delta
+		}
+	}
+	return refs
+}
+
+// addRefCounts adds to the reference counts of values of a data file and syncs the hash file
+func addRefCounts(refFilePath string, refs map[[2]int64]int64) error {
+	state := refState(refFilePath)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	err := state.load(refFilePath)
+	if err != nil {
+		return err
+	}
+
+	// Every value is looked up before a count changes
+	for offsets := range refs {
+		if _, exists := state.stored[offsets]; !exists {
+			return fmt.Errorf("no value is stored at %d-%d", offsets[0], offsets[1])
+		}
+	}
+
+	for offsets, n := range refs {
+		entry := state.stored[offsets]
+		entry.count += n
+		err := writeRefHash(refFilePath, entry.position, encodeRefHash(entry))
+		if err != nil {
+			return err
+		}
+	}
+
+	return syncFile(refHashPath(refFilePath))
+}
+
+// encodeRefHash encodes an entry of the hash file
+func encodeRefHash(entry *refContentEntry) []byte {
+	data := make([]byte, refContentEntrySize)
+	copy(data, entry.hash[:])
+	binary.LittleEndian.PutUint64(data[sha256.Size:], uint64(entry.offsets[0]))
+	binary.LittleEndian.PutUint64(data[sha256.Size+8:], uint64(entry.offsets[1]))
+	binary.LittleEndian.PutUint64(data[sha256.Size+16:], uint64(entry.count))
+	return data
+}
+
+// decodeRefHash decodes an entry of the hash file
+func decodeRefHash(data []byte) *refContentEntry {
+	entry := &refContentEntry{}
+	copy(entry.hash[:], data[:sha256.Size])
+	entry.offsets[0] = int64(binary.LittleEndian.Uint64(data[sha256.Size:]))
+	entry.offsets[1] = int64(binary.LittleEndian.Uint64(data[sha256.Size+8:]))
+	entry.count = int64(binary.LittleEndian.Uint64(data[sha256.Size+16:]))
+	return entry
+}
+
+// countedRefHashes encodes the hash file of the values the records refer to, every value is counted once per record
+// The records refer to values of a data file that is about to be used, data holds its content
+func countedRefHashes(data []byte, field Field, records []*Record) ([]byte, error) {
+	var entries []*refContentEntry
+	counted := make(map[[2]int64]*refContentEntry)
+	for _, record := range records {
+		offsets, exists := record.RefOffsets[field.Name]
+		if !exists {
+			continue
+		}
+		if entry, processed := counted[offsets]; processed {
+			entry.count++
+			continue
+		}
+
+		// A value that can't be read can't be counted, it would be removed while the record refers to it
+		if offsets[0] < 0 || offsets[1] > int64(len(data)) || offsets[0] > offsets[1] {
+			return nil, fmt.Errorf("record %d has invalid offsets %d-%d for field '%s'", record.ID, offsets[0], offsets[1], field.Name)
+		}
+		hash, err := refValueHash(bytes.NewReader(data), offsets)
+		if err != nil {
+			return nil, fmt.Errorf("record %d has an unreadable value in field '%s': %v", record.ID, field.Name, err)
+		}
+
+		entry := &refContentEntry{hash: hash, offsets: offsets, count: 1}
+		entries = append(entries, entry)
+		counted[offsets] = entry
+	}
+
+	var hashes []byte
+	for _, entry := range entries {
+		hashes = append(hashes, encodeRefHash(entry)...)
+	}
+	return hashes, nil
+}
+
+// upgradeRefCounts writes the hash files of the dedup fields with the reference counts of the stored records
+// Tables before format version 6 listed the values without counts. The new files get the .upgrade ending and
+// are moved into place with the table file
+func (t *Table) upgradeRefCounts(records []*Record) error {
+	for _, field := range t.Fields {
+		if !field.Dedup {
+			continue
+		}
+
+		refFilePath := t.refPath(field.Name)
+		refData, err := os.ReadFile(refFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read ref field file: %v", err)
+		}
+
+		hashes, err := countedRefHashes(refData, field, records)
+		if err != nil {
+			return err
+		}
+		err = writeSyncedFile(refHashPath(refFilePath)+".upgrade", hashes)
+		if err != nil {
+			return fmt.Errorf("failed to write ref hash file: %v", err)
+		}
+	}
+	return nil
+}
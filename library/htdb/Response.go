@@ -22,9 +22,21 @@ const (
 	StatusSchenaDoesntExist   = 401
 	StatusTableDoesntExist    = 402
 	StatusFieldDoesntExist    = 403
+	StatusRecordNotFound      = 404
 	StatusSchenaAlreadyExists = 411
 	StatusTableAlreadyExists  = 412
 	StatusFieldAlreadyExists  = 413
+	StatusIndexAlreadyExists  = 414
+	StatusUniqueViolation     = 421
+	StatusValidationFailed    = 422
+	StatusWriteConflict       = 431
+	StatusLockTimeout         = 432
+	StatusDeadlock            = 433
+	StatusTableChanged        = 434
+	StatusTableBusy           = 435
+	StatusDatabaseLocked      = 441
+	StatusReadOnly            = 442
+	StatusDatabaseClosed      = 443
 	StatusInvalidName         = 491
 	StatusDbError             = 500
 	StatusInternalError       = 501
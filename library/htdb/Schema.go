@@ -30,6 +30,14 @@ func (db *HTDB) Schema(name string) (*Schema, error) {
 }
 
 func (db *HTDB) CreateSchema(name string) (*Schema, error) {
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	if err := checkName("Schema", name); err != nil {
+		return nil, err
+	}
+
 	pathSchema := db.mainPath + "/" + name
 
 	if _, err := os.Stat(pathSchema); os.IsNotExist(err) {
@@ -38,7 +46,8 @@ func (db *HTDB) CreateSchema(name string) (*Schema, error) {
 			return nil, NewResponse(StatusDbError, fmt.Sprint(err))
 		}
 
-		_, err = os.Create(pathSchema + "/index.conf" + fileEnding)
+		// The schema catalog lists the tables of the schema
+		err = writeCatalog(pathSchema, newCatalog())
 		if err != nil {
 			return nil, NewResponse(StatusDbError, fmt.Sprint(err))
 		}
@@ -0,0 +1,153 @@
+// Snapshot.go
+// Description: Snapshot isolation for the HTDB library
+// Transactions read the versions that were committed when they began and see their own staged changes,
+// commits fail if another transaction committed a change to the same row in the meantime
+// Author: harto.dev
+
+package htdb
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// ConflictError is returned by Commit if a row was changed by another transaction after the snapshot was taken
+// The transaction is rolled back and has to be retried
+type ConflictError struct {
+	Response
+	Table  string `json:"table"`
+	RowKey int64  `json:"rowKey"`
+}
+
+// newConflictError creates the error for a row that was changed by another transaction
+func newConflictError(table *Table, rowKey int64) ConflictError {
+	message := fmt.Sprintf("Record %d in table '%s' was changed by another transaction", rowKey, table.TableName)
+	return ConflictError{
+		Response: NewResponse(StatusWriteConflict, message),
+		Table:    table.TableName,
+		RowKey:   rowKey,
+	}
+}
+
+// openSnapshot takes the snapshot of a new transaction, the cleanup keeps the versions it reads until it is closed
+// The snapshot is taken and registered in one step, so a cleanup run either sees it or started before it
+func (tm *TableManager) openSnapshot(txID uint64) int64 {
+	tm.snapshotsMu.Lock()
+	defer tm.snapshotsMu.Unlock()
+
+	snapshot := atomic.LoadInt64(&tm.db.lastCommit)
+	tm.snapshots[txID] = snapshot
+	return snapshot
+}
+
+// closeSnapshot releases the snapshot of a transaction that ended
+func (tm *TableManager) closeSnapshot(txID uint64) {
+	tm.snapshotsMu.Lock()
+	defer tm.snapshotsMu.Unlock()
+
+	delete(tm.snapshots, txID)
+}
+
+// oldestSnapshot returns the snapshot of the oldest active transaction
+func (tm *TableManager) oldestSnapshot() (int64, bool) {
+	tm.snapshotsMu.Lock()
+	defer tm.snapshotsMu.Unlock()
+
+	var oldest int64
+	found := false
+	for _, snapshot := range tm.snapshots {
+		if !found || snapshot < oldest {
+			oldest, found = snapshot, true
+		}
+	}
+	return oldest, found
+}
+
+// Select starts a query that reads the snapshot of the transaction
+func (tx *Transaction) Select(table *Table) *Query {
+	q := tx.db.GetTableManager().Select(table)
+	q.asOf = tx.Snapshot
+	q.tx = tx
+	return q
+}
+
+// GetRecordByID gets the version of a row that is visible to the transaction
+func (tx *Transaction) GetRecordByID(table *Table, id int64) (*Record, error) {
+	for _, staged := range tx.stagedRows(table) {
+		if staged.RowKey != id {
+			continue
+		}
+		if staged.Metadata.IsDeleted {
+			return nil, NewResponse(StatusRecordNotFound, "Record not found")
+		}
+		return staged, nil
+	}
+
+	history, err := tx.db.GetTableManager().History(table, id)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := versionsAt(history, tx.Snapshot)
+	if len(visible) == 0 || visible[0].Metadata.IsDeleted {
+		return nil, NewResponse(StatusRecordNotFound, "Record not found")
+	}
+
+	return visible[0], nil
+}
+
+// stagedRows returns the latest staged version of every row the transaction changed in a table
+func (tx *Transaction) stagedRows(table *Table) []*Record {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	var rows []*Record
+	index := make(map[int64]int)
+	for _, record := range tx.StagedRecords[table.ID()] {
+		if i, exists := index[record.RowKey]; exists {
+			rows[i] = record
+			continue
+		}
+		index[record.RowKey] = len(rows)
+		rows = append(rows, record)
+	}
+	return rows
+}
+
+// checkWriteConflicts checks that no other transaction changed the rows this transaction updates or deletes
+// The first committer wins, the version a row was staged from has to be its current version
+func (tx *Transaction) checkWriteConflicts(table *Table, records []*Record) error {
+	tm := tx.db.GetTableManager()
+
+	// The first staged version of a row was staged from the version the transaction read
+	seen := make(map[int64]bool)
+	base := make(map[int64]int64)
+	var rowKeys []int64
+	for _, record := range records {
+		if seen[record.RowKey] {
+			continue
+		}
+		seen[record.RowKey] = true
+
+		// Rows inserted by this transaction can't conflict
+		if record.PrevID == 0 {
+			continue
+		}
+		base[record.RowKey] = record.PrevID
+		rowKeys = append(rowKeys, record.RowKey)
+	}
+	sort.Slice(rowKeys, func(i, j int) bool { return rowKeys[i] < rowKeys[j] })
+
+	for _, rowKey := range rowKeys {
+		head, exists, err := tm.headVersion(table, rowKey)
+		if err != nil {
+			return err
+		}
+		if !exists || head.id != base[rowKey] {
+			return newConflictError(table, rowKey)
+		}
+	}
+
+	return nil
+}
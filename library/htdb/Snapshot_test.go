@@ -0,0 +1,89 @@
+package htdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCleanupKeepsVersionsOfOpenSnapshots(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+
+	record, err := tm.InsertRecord(table, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The row is updated while a transaction reads the snapshot before the update
+	tx := tm.BeginTransaction()
+	if _, err := tm.UpdateRecord(table, record, map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := tx.Select(table).First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.FieldsData["n"] != int64(1) {
+		t.Fatalf("snapshot reads n = %v after the cleanup, want 1", found.FieldsData["n"])
+	}
+	if err := tm.RollbackTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without open snapshots the replaced version is dropped
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+	records, err := tm.current(table).readAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].FieldsData["n"] != int64(2) {
+		t.Fatalf("table file has %d versions after the snapshot was closed, want the current one", len(records))
+	}
+}
+
+func TestOpenSeedsTimestampsFromCommittedVersions(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	if _, err := db.GetTableManager().InsertRecord(table, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The version was committed by a clock that is an hour ahead
+	records, err := table.GetAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	records[0].ID = ahead
+	if err := table.WriteRecords(records); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, dir)
+	tm := db.GetTableManager()
+	record, err := tm.InsertRecord(table, map[string]interface{}{"n": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.ID <= ahead {
+		t.Fatalf("new version got ID %d, not after the committed version %d", record.ID, ahead)
+	}
+
+	tx := tm.BeginTransaction()
+	defer tm.RollbackTransaction(tx)
+	if count, err := tx.Select(table).Count(); err != nil || count != 2 {
+		t.Fatalf("snapshot sees %d rows (%v), want 2", count, err)
+	}
+}
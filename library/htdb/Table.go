@@ -5,23 +5,71 @@
 package htdb
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Table struct {
-	TableName  string  `json:"tableName"`
-	Fields     []Field `json:"fields"`
-	SchemaPath string  `json:"schemaPath"`
+	TableName     string          `json:"tableName"`
+	Fields        []Field         `json:"fields"`
+	Indexes       []string        `json:"indexes,omitempty"`       // Names of the indexed fields
+	FormatVersion int             `json:"formatVersion"`           // Layout of the table file
+	LayoutVersion int             `json:"layoutVersion,omitempty"` // Number of changes of the fields, records are stored in this layout
+	Migration     *FieldMigration `json:"migration,omitempty"`     // Pending change of the fields
+	RenamedFrom   string          `json:"renamedFrom,omitempty"`   // Old name while the files of a renamed table are moved
+	Generation    int             `json:"generation,omitempty"`    // Number of compactions of the table files, see compactTable
+	CreatedAt     time.Time       `json:"createdAt"`
+	SchemaPath    string          `json:"schemaPath"`
+	db            *HTDB           // Set for tables loaded through a TableManager
 }
 
+// TableID identifies a table by its schema and name, tables of different schemas can share a name
+type TableID struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+}
+
+// String returns the schema:table form of the identity
+func (id TableID) String() string {
+	return id.Schema + ":" + id.Table
+}
+
+// ParseTableID parses a table name in the schema:table form
+func ParseTableID(name string) (TableID, error) {
+	parts := strings.Split(name, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return TableID{}, NewResponse(StatusBadRequest, "Table name "+name+" is not in the schema:table form")
+	}
+	return TableID{Schema: parts[0], Table: parts[1]}, nil
+}
+
+// ID returns the identity of the table
+func (t *Table) ID() TableID {
+	return TableID{Schema: filepath.Base(t.SchemaPath), Table: t.TableName}
+}
+
+// tableFormatVersion is the layout new table files are written in
+// 1: 12 byte record header, versions are replaced by clearing IsCurrent
+// 2: 20 byte record header with PrevID, the table file is append-only
+// 3: 28 byte record header with the RowKey that all versions of a row share
+// 4: float fields hold the IEEE 754 bits of their value instead of the value cut to an integer
+// 5: ref and blob values start with a header byte that names their compression, see RefCompression.go
+// 6: dedup hash files keep a reference count per value, see RefContent.go
+const tableFormatVersion = 6
+
 type Field struct {
 	Name        string       `json:"name"`
 	Type        FieldTypes   `json:"type"`
 	Length      uint         `json:"length,omitempty"`
+	Precision   int          `json:"precision,omitempty"`   // Number of digits of a decimal field
+	Scale       int          `json:"scale,omitempty"`       // Number of digits of a decimal field after the decimal point
+	Version     int          `json:"version,omitempty"`     // UUID version of a uuid field, 4 (random) or 7 (time ordered)
+	Dedup       bool         `json:"dedup,omitempty"`       // Values of a ref or blob field are stored once per content, see RefContent.go
+	Compression string       `json:"compression,omitempty"` // Compression of new ref or blob values: "zstd", "gzip" or "none"
 	Constraints []Constraint `json:"constraints"`
 }
 
@@ -33,6 +81,17 @@ const (
 	Float  FieldTypes = "float"
 	Bool   FieldTypes = "bool"
 	TimeID FieldTypes = "timeID"
+	// Date, Timestamp and Duration fields hold time.Time and time.Duration values
+	Date      FieldTypes = "date"
+	Timestamp FieldTypes = "timestamp"
+	Duration  FieldTypes = "duration"
+	// Blob fields hold binary values, they are stored in a data file per field like ref fields
+	Blob FieldTypes = "blob"
+	// Decimal fields hold exact fixed-point values as *big.Rat
+	Decimal FieldTypes = "decimal"
+	// UUID and Serial fields are generated when a record is inserted, see KeyFields.go
+	UUID   FieldTypes = "uuid"
+	Serial FieldTypes = "serial"
 	// unsure -- Arrays or List will work similar to the reference type
 )
 
@@ -53,12 +112,16 @@ func NewTable(name string, fields []Field) Table {
 
 // Function to create a database table
 func (s *Schema) CreateTable(name string, fields []Field) Response {
+	if err := s.db.checkWritable(); err != nil {
+		return err.(Response)
+	}
+
 	// Prepend the timePKField to fields
 	fields = append([]Field{timePKField}, fields...)
+	fields = withDefaultLengths(fields)
 
 	// Set the path for the schema and table
 	var pathTable = s.schemaPath + "/" + name + fileEnding
-	var pathConf = s.schemaPath + "/" + name + ".conf" + fileEnding
 
 	// Check schema
 	if _, err := os.Stat(s.schemaPath); os.IsNotExist(err) {
@@ -79,7 +142,7 @@ func (s *Schema) CreateTable(name string, fields []Field) Response {
 		return Response{time.Now().String(), 406, "You have to give the table a name"}
 	}
 
-	if strings.HasPrefix(name, ".") {
+	if strings.HasPrefix(name, ".") || strings.ContainsAny(name, ":/\\") {
 		return Response{time.Now().String(), 406, "Can't name a Table like that, sowwy"}
 	}
 
@@ -87,164 +150,438 @@ func (s *Schema) CreateTable(name string, fields []Field) Response {
 		return Response{time.Now().String(), 406, "Can't name a Table \"index\", sowwy"}
 	}
 
+	if isGenerationName(name) {
+		return Response{time.Now().String(), 406, "Can't name a Table like the files of a compacted table, sowwy"}
+	}
+
 	// Validate field lengths
 	if err := validateFieldLengths(fields); err != nil {
 		return Response{time.Now().String(), 406, err.Error()}
 	}
 
+	// Validate constraints
+	if err := validateConstraints(fields); err != nil {
+		return Response{time.Now().String(), 406, err.Error()}
+	}
+
+	// Create the configuration
+	newTable := Table{
+		TableName:     name,
+		Fields:        fields,
+		FormatVersion: tableFormatVersion,
+		CreatedAt:     time.Now(),
+		SchemaPath:    s.schemaPath,
+	}
+
+	// Files created before the table is in the catalog belong to no table, they are removed if a step fails
+	removeFiles := func() {
+		for _, path := range newTable.filePaths() {
+			os.Remove(path)
+		}
+	}
+
 	// Create the file for the table
 	file, err := os.Create(pathTable)
-	defer file.Close() // Close the file after function ends
 	if err != nil {
 		// Return error if file creation fails
 		return Response{time.Now().String(), 500, "Failed to create table file: " + err.Error()}
 	}
+	file.Close()
 
 	// Create a separate data file for each ref field
 	for _, field := range fields {
-		if field.Type == "ref" {
-			refFilePath := s.schemaPath + "/" + name + "." + field.Name + ".data" + fileEnding
-			refFile, err := os.Create(refFilePath)
+		if isRefField(field) {
+			refFile, err := os.Create(newTable.refPath(field.Name))
 			if err != nil {
+				removeFiles()
 				return Response{time.Now().String(), 500, "Failed to create ref field file: " + err.Error()}
 			}
 			refFile.Close()
 		}
 	}
 
-	confFile, err := os.Create(pathConf)
-	if err != nil {
-		return Response{time.Now().String(), 500, fmt.Sprint(err)}
-	}
-	defer confFile.Close()
-
-	// Create the configuration file
-	newTable := Table{
-		TableName:  name,
-		Fields:     fields,
-		SchemaPath: s.schemaPath,
-	}
-
-	// Serialize the table to JSON
-	tableJSON, err := json.MarshalIndent(newTable, "", "  ")
-	if err != nil {
-		return Response{time.Now().String(), 500, "Failed to serialize table to JSON: " + err.Error()}
+	// Unique fields and the primary key get an index so constraints can be checked without a full scan
+	for _, field := range fields {
+		if field.IsUnique() {
+			index, err := openBTree(newTable.indexPath(field.Name), indexKeyLength(field))
+			if err != nil {
+				removeFiles()
+				return Response{time.Now().String(), 500, "Failed to create index file: " + err.Error()}
+			}
+			index.Close()
+			newTable.Indexes = append(newTable.Indexes, field.Name)
+		}
 	}
 
-	// Write JSON to configuration file
-	err = os.WriteFile(pathConf, tableJSON, 0644)
+	// Add the table to the schema catalog, from here on the table exists
+	exists := false
+	err = updateCatalog(s.schemaPath, func(catalog *schemaCatalog) error {
+		if _, exists = catalog.Tables[name]; exists {
+			return fmt.Errorf("table %s already exists", name)
+		}
+		catalog.Tables[name] = &newTable
+		return nil
+	})
 	if err != nil {
-		return Response{time.Now().String(), 500, "Failed to write JSON to configuration file: " + err.Error()}
+		// The files of a table that was created at the same time are left alone
+		if !exists {
+			removeFiles()
+		}
+		return Response{time.Now().String(), 500, "Failed to add the table to the schema catalog: " + err.Error()}
 	}
 
 	// Log success message
 	return Response{time.Now().String(), 200, "Table created successfully"}
 }
 
+// withDefaultLengths returns a copy of the fields where fields of a fixed size type without a length get it
+func withDefaultLengths(fields []Field) []Field {
+	result := make([]Field, len(fields))
+	for i, f := range fields {
+		if f.Type == Bool && f.Length == 0 {
+			f.Length = 1
+		}
+		if isTimeField(f) && f.Length == 0 {
+			f.Length = 8
+		}
+		if f.Type == Blob && f.Length == 0 {
+			f.Length = 16
+		}
+		if f.Type == Decimal && f.Length == 0 {
+			f.Length = decimalLength
+		}
+		if f.Type == Decimal && f.Precision == 0 {
+			f.Precision = decimalDefaultPrecision
+		}
+		if f.Type == UUID && f.Length == 0 {
+			f.Length = uuidLength
+		}
+		if f.Type == UUID && f.Version == 0 {
+			f.Version = defaultUUIDVersion
+		}
+		if f.Type == Serial && f.Length == 0 {
+			f.Length = 8
+		}
+		result[i] = f
+	}
+	return result
+}
+
 func validateFieldLengths(fields []Field) error {
 	for _, f := range fields {
+		if f.Type == Bool && f.Length != 1 {
+			return fmt.Errorf("field '%s' of type 'bool' must have a length of 1 byte", f.Name)
+		}
+		if f.Type == Decimal {
+			if err := validateDecimalField(f); err != nil {
+				return err
+			}
+		}
+		if f.Dedup && !isRefField(f) {
+			return fmt.Errorf("field '%s' of type '%s' can't be deduplicated, only ref and blob fields can", f.Name, f.Type)
+		}
+		if err := validateCompression(f); err != nil {
+			return err
+		}
+		if f.Type == UUID && f.Length != uuidLength {
+			return fmt.Errorf("field '%s' of type 'uuid' must have a length of %d bytes", f.Name, uuidLength)
+		}
+		if f.Type == UUID && f.Version != 4 && f.Version != 7 {
+			return fmt.Errorf("field '%s' of type 'uuid' must have version 4 or 7", f.Name)
+		}
+		if f.Type == Serial && f.Length != 8 {
+			return fmt.Errorf("field '%s' of type 'serial' must have a length of 8 bytes", f.Name)
+		}
+		if f.Type == Blob && f.Length != 16 {
+			return fmt.Errorf("field '%s' of type 'blob' must have a length of 16 bytes", f.Name)
+		}
 		if f.Type == "ref" && f.Length != 128 {
 			return fmt.Errorf("field '%s' of type 'ref' must have a length of %d bytes", f.Name, 128)
 		}
 		if f.Type == "timeID" && f.Length != 8 {
 			return fmt.Errorf("field '%s' of type 'timeID' must have a length of 8 bytes", f.Name)
 		}
+		if isTimeField(f) && f.Length != 8 {
+			return fmt.Errorf("field '%s' of type '%s' must have a length of 8 bytes", f.Name, f.Type)
+		}
 	}
 	return nil
 }
 
-// GetTable returns a table by name from a schema
+// GetTable returns a table by its schema:table name
+// Names without a schema can be resolved with HTDB.ResolveTable first
 func GetTable(tableName string, mainPath string) (*Table, error) {
-	// Split the tableName into schema and table parts if it contains a colon
-	parts := strings.Split(tableName, ":")
-	var schemaName, tableNameOnly string
-
-	if len(parts) > 1 {
-		schemaName = parts[0]
-		tableNameOnly = parts[1]
-	} else {
-		// Default schema
-		schemaName = "testSchema" // or any default schema you want to use
-		tableNameOnly = tableName
+	id, err := ParseTableID(tableName)
+	if err != nil {
+		return nil, err
 	}
+	schemaName, tableNameOnly := id.Schema, id.Table
 
 	// Construct paths
 	schemaPath := mainPath + "/" + schemaName
-	tableConfPath := schemaPath + "/" + tableNameOnly + ".conf" + fileEnding
 
 	// Check if the schema exists
 	if _, err := os.Stat(schemaPath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("schema '%s' does not exist", schemaName)
 	}
 
-	// Check if the table configuration exists
-	if _, err := os.Stat(tableConfPath); os.IsNotExist(err) {
+	// The schema catalog holds the configuration of every table
+	catalog, err := readCatalog(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	table, exists := catalog.Tables[tableNameOnly]
+	if !exists {
 		return nil, fmt.Errorf("table '%s' does not exist in schema '%s'", tableNameOnly, schemaName)
 	}
 
-	// Read the table configuration
-	tableConf, err := os.ReadFile(tableConfPath)
+	// Set the schema path
+	table.TableName = tableNameOnly
+	table.SchemaPath = schemaPath
+
+	return table, nil
+}
+
+// finishUpgrades moves the files of upgrades that were interrupted after the configuration was written into place
+// This runs before the write-ahead log is replayed, the logged records are appended to the upgraded table files
+func (db *HTDB) finishUpgrades() error {
+	return db.forEachTable(func(table *Table) error {
+		if table.FormatVersion < tableFormatVersion {
+			return nil
+		}
+		err := table.finishUpgrade()
+		if err != nil {
+			return fmt.Errorf("failed to upgrade table '%s': %v", table.TableName, err)
+		}
+		return nil
+	})
+}
+
+// upgradeTables brings the table files of all schemas to the current format
+// Logged commits are written in the format of their table, so the write-ahead log is replayed first
+func (db *HTDB) upgradeTables() error {
+	return db.forEachTable(func(table *Table) error {
+		if table.FormatVersion >= tableFormatVersion {
+			return nil
+		}
+		if db.walDirty {
+			return fmt.Errorf("table '%s' can't be upgraded before the logged commits are applied", table.TableName)
+		}
+		err := table.upgradeFormat()
+		if err != nil {
+			return fmt.Errorf("failed to upgrade table '%s': %v", table.TableName, err)
+		}
+		return nil
+	})
+}
+
+// forEachTable loads every table of every schema and calls fn for it
+func (db *HTDB) forEachTable(fn func(table *Table) error) error {
+	schemas, err := db.ListSchemas()
+	if err != nil {
+		return err
+	}
+
+	for _, schema := range schemas {
+		tables, err := listTables(filepath.Join(db.mainPath, schema))
+		if err != nil {
+			return err
+		}
+
+		for _, tableName := range tables {
+			table, err := GetTable(schema+":"+tableName, db.mainPath)
+			if err != nil {
+				return err
+			}
+
+			err = fn(table)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// finishUpgrade moves the new table files into place if an upgrade was interrupted after the configuration was written
+func (t *Table) finishUpgrade() error {
+	if _, err := os.Stat(t.dataPath() + ".upgrade"); err != nil {
+		return nil
+	}
+	return t.replaceUpgradedFiles()
+}
+
+// replaceUpgradedFiles moves the files written by upgradeFormat into place
+// The table file is moved last, as long as it is left the upgrade is finished when the database is opened again
+func (t *Table) replaceUpgradedFiles() error {
+	for _, field := range t.Fields {
+		if !isRefField(field) {
+			continue
+		}
+		for _, path := range []string{t.refPath(field.Name), refHashPath(t.refPath(field.Name))} {
+			if _, err := os.Stat(path + ".upgrade"); err != nil {
+				continue
+			}
+			err := os.Rename(path+".upgrade", path)
+			if err != nil {
+				return fmt.Errorf("failed to replace ref field file: %v", err)
+			}
+		}
+		forgetRefContent(t.refPath(field.Name))
+	}
+
+	err := os.Rename(t.dataPath()+".upgrade", t.dataPath())
 	if err != nil {
-		return nil, fmt.Errorf("failed to read table configuration: %v", err)
+		return fmt.Errorf("failed to replace table file: %v", err)
+	}
+
+	// Indexed values can change, the indexes are rebuilt when they are opened the next time
+	for _, name := range t.Indexes {
+		os.Remove(t.indexPath(name))
 	}
+	syncDir(t.SchemaPath)
 
-	var table Table
-	err = json.Unmarshal(tableConf, &table)
+	return nil
+}
+
+// upgradeFormat rewrites the table file in the current format
+// The new file is written next to the old one and only moved into place after the configuration is updated
+// It runs when the database is opened for writing, so nothing else uses the table at the same time
+func (t *Table) upgradeFormat() error {
+	records, err := t.readAllRecords()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse table configuration: %v", err)
+		return err
 	}
 
-	// Set the schema path
-	table.SchemaPath = schemaPath
+	// Versions written before rows had keys belong to the row of the version they replace
+	rowKeys := make(map[int64]int64)
+	for _, record := range records {
+		if rowKey, exists := rowKeys[record.PrevID]; exists && record.PrevID != 0 {
+			record.RowKey = rowKey
+			record.FieldsData["id"] = rowKey
+		}
+		rowKeys[record.ID] = record.RowKey
+	}
+
+	// Ref and blob values get their header byte, which moves them in the data files
+	// The hash files of dedup fields are written with the reference counts of the stored records
+	if t.FormatVersion < 5 {
+		err = t.upgradeRefFiles(records)
+	} else if t.FormatVersion < 6 {
+		err = t.upgradeRefCounts(records)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = writeRecordsFile(t.dataPath()+".upgrade", t.Fields, records)
+	if err != nil {
+		return err
+	}
 
-	return &table, nil
+	t.FormatVersion = tableFormatVersion
+	err = t.saveConfig()
+	if err != nil {
+		return err
+	}
+
+	return t.replaceUpgradedFiles()
 }
 
 // WriteRecords writes records to the table file
 func (t *Table) WriteRecords(records []*Record) error {
 	// Construct the table file path
-	tablePath := t.SchemaPath + "/" + t.TableName + fileEnding
+	tablePath := t.dataPath()
 
-	// Create a temporary file
+	// Write to a temporary file first
 	tempPath := tablePath + ".temp"
-	tempFile, err := os.Create(tempPath)
+	err := writeRecordsFile(tempPath, t.Fields, records)
+	if err != nil {
+		return err
+	}
+
+	// Replace the old file with the new one
+	err = os.Rename(tempPath, tablePath)
+	if err != nil {
+		return fmt.Errorf("failed to replace table file: %v", err)
+	}
+	syncDir(t.SchemaPath)
+
+	return nil
+}
+
+// writeRecordsFile writes records to a new file and syncs it to disk
+func writeRecordsFile(path string, fields []Field, records []*Record) error {
+	// Create the file
+	file, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("failed to create temporary file: %v", err)
 	}
-	defer tempFile.Close()
+	defer file.Close()
 
-	// Write each record to the temporary file
+	// Write each record to the file
 	for _, record := range records {
-		data, err := record.Serialize(t.Fields)
+		data, err := record.Serialize(fields)
 		if err != nil {
 			return fmt.Errorf("failed to serialize record: %v", err)
 		}
 
-		_, err = tempFile.Write(data)
+		_, err = file.Write(data)
 		if err != nil {
 			return fmt.Errorf("failed to write record to temporary file: %v", err)
 		}
 	}
 
-	// Close the temporary file
-	tempFile.Close()
-
-	// Replace the old file with the new one
-	err = os.Rename(tempPath, tablePath)
+	// Make sure the data is on disk before the file is used
+	err = file.Sync()
 	if err != nil {
-		return fmt.Errorf("failed to replace table file: %v", err)
+		return fmt.Errorf("failed to sync temporary file: %v", err)
 	}
 
 	return nil
 }
 
+// syncRefFiles syncs the data files of all ref fields of the table
+func (t *Table) syncRefFiles() error {
+	for _, field := range t.Fields {
+		if isRefField(field) {
+			err := syncFile(t.refPath(field.Name))
+			if err != nil {
+				return fmt.Errorf("failed to sync ref field file: %v", err)
+			}
+			if field.Dedup {
+				err = syncFile(refHashPath(t.refPath(field.Name)))
+				if err != nil {
+					return fmt.Errorf("failed to sync ref hash file: %v", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // GetAllRecords reads all records from the table file
+// Tables loaded through a TableManager read the files of the current generation, also after a compaction
 func (t *Table) GetAllRecords() ([]*Record, error) {
+	if t.db != nil {
+		t = t.db.GetTableManager().current(t)
+	}
+	return t.readAllRecords()
+}
+
+// readAllRecords reads all records from the table file of the generation of the handle
+func (t *Table) readAllRecords() ([]*Record, error) {
 	// Construct the table file path
-	tablePath := t.SchemaPath + "/" + t.TableName + fileEnding
+	tablePath := t.dataPath()
 
 	// Check if the table file exists
 	if _, err := os.Stat(tablePath); os.IsNotExist(err) {
+		// The files of an older generation are removed by the cleanup worker
+		if t.Generation > 0 {
+			return nil, tableCompacted(t.TableName)
+		}
 		return []*Record{}, nil // Return empty slice if file doesn't exist
 	}
 
@@ -254,20 +591,8 @@ func (t *Table) GetAllRecords() ([]*Record, error) {
 		return nil, fmt.Errorf("failed to read table file: %v", err)
 	}
 
-	// Calculate record size
-	recordSize := 0
-	for _, field := range t.Fields {
-		if field.Name == "id" {
-			continue // ID is handled separately
-		}
-		recordSize += int(field.Length)
-		recordSize += 1 // Field metadata (1 byte for isNull)
-	}
-
-	// Add metadata size
-	recordSize += 12 // 8 bytes for ID, 4 bytes for metadata
-
 	// Parse records
+	recordSize := t.recordSize()
 	var records []*Record
 	for i := 0; i < len(data); i += recordSize {
 		if i+recordSize > len(data) {
@@ -275,13 +600,168 @@ func (t *Table) GetAllRecords() ([]*Record, error) {
 		}
 
 		recordData := data[i : i+recordSize]
-		record, err := DeserializeRecord(recordData, t.Fields)
+		record, err := deserializeRecord(recordData, t.Fields, t.FormatVersion)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize record: %v", err)
+		}
+		record.generation = t.Generation
+
+		records = append(records, record)
+	}
+
+	// Resolve which records are the latest versions
+	resolveVersions(records)
+
+	return records, nil
+}
+
+// readRecordsAt reads the records at the given positions of the table file
+// IsCurrent is only the stored flag, use TableManager.recordsAt to resolve the latest versions
+func (t *Table) readRecordsAt(positions []int64) ([]*Record, error) {
+	file, err := os.Open(t.dataPath())
+	if os.IsNotExist(err) && t.Generation > 0 {
+		return nil, tableCompacted(t.TableName)
+	}
+	if os.IsNotExist(err) {
+		return []*Record{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open table file: %v", err)
+	}
+	defer file.Close()
+
+	recordSize := t.recordSize()
+	data := make([]byte, recordSize)
+
+	var records []*Record
+	for _, pos := range positions {
+		_, err := file.ReadAt(data, pos*int64(recordSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record at position %d: %v", pos, err)
+		}
+
+		record, err := deserializeRecord(data, t.Fields, t.FormatVersion)
 		if err != nil {
 			return nil, fmt.Errorf("failed to deserialize record: %v", err)
 		}
+		record.generation = t.Generation
 
 		records = append(records, record)
 	}
 
 	return records, nil
 }
+
+// lastVersionID returns the ID of the last version in the table file, 0 if the table has no records
+// Commits are appended in ID order, so it is the highest ID of the table
+func (t *Table) lastVersionID() (int64, error) {
+	stat, err := os.Stat(t.dataPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read table file: %v", err)
+	}
+
+	count := stat.Size() / int64(t.recordSize())
+	if count == 0 {
+		return 0, nil
+	}
+	records, err := t.readRecordsAt([]int64{count - 1})
+	if err != nil {
+		return 0, err
+	}
+	return records[0].ID, nil
+}
+
+// recordSize returns the size of a serialized record in bytes
+func (t *Table) recordSize() int {
+	recordSize := headerSizeFor(t.FormatVersion)
+	for _, field := range t.Fields {
+		if field.Name == "id" {
+			continue // ID is handled separately
+		}
+		recordSize += int(field.Length)
+		recordSize += 1 // Field metadata (1 byte for isNull)
+	}
+	return recordSize
+}
+
+// getField returns the field with the given name
+func (t *Table) getField(name string) (Field, bool) {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// hasIndex checks if a field of the table is indexed
+func (t *Table) hasIndex(name string) bool {
+	for _, index := range t.Indexes {
+		if index == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dataPath returns the path of the table file
+func (t *Table) dataPath() string {
+	return t.SchemaPath + "/" + t.TableName + generationSuffix(t.Generation) + fileEnding
+}
+
+// generationSuffix returns the part of a file name that names the generation of the table files
+// Every compaction writes the files of a table under the next generation, the files of generation 0 have no suffix
+func generationSuffix(generation int) string {
+	if generation == 0 {
+		return ""
+	}
+	return ".g" + strconv.Itoa(generation)
+}
+
+// isGenerationName checks if a table name ends like the files of a compacted table, such names are not allowed
+func isGenerationName(name string) bool {
+	i := strings.LastIndex(name, ".g")
+	if i < 0 || i+2 == len(name) {
+		return false
+	}
+	_, err := strconv.Atoi(name[i+2:])
+	return err == nil
+}
+
+// isRefField checks if the values of a field are stored in a data file of their own
+func isRefField(field Field) bool {
+	return field.Type == "ref" || field.Type == Blob
+}
+
+// refPath returns the path of the data file of a ref field
+func (t *Table) refPath(fieldName string) string {
+	return refDataPath(t.SchemaPath, t.TableName, fieldName, t.Generation)
+}
+
+// refFilePath returns the path of the data file of a ref field in a generation of the table files
+func refDataPath(schemaPath, tableName, fieldName string, generation int) string {
+	return schemaPath + "/" + tableName + "." + fieldName + generationSuffix(generation) + ".data" + fileEnding
+}
+
+// indexPath returns the path of the index file of a field
+func (t *Table) indexPath(fieldName string) string {
+	return t.SchemaPath + "/" + t.TableName + "." + fieldName + generationSuffix(t.Generation) + ".index" + fileEnding
+}
+
+// saveConfig writes the table configuration to the schema catalog
+func (t *Table) saveConfig() error {
+	table := *t
+	table.db = nil
+
+	return updateCatalog(t.SchemaPath, func(catalog *schemaCatalog) error {
+		// Handles loaded before a compaction don't take the generation back
+		if stored, exists := catalog.Tables[t.TableName]; exists && stored.Generation > table.Generation {
+			table.Generation = stored.Generation
+		}
+		catalog.Tables[t.TableName] = &table
+		return nil
+	})
+}
@@ -8,6 +8,7 @@ package htdb
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,18 +18,50 @@ type TableManager struct {
 	cleanupWorker  *CleanupWorker
 	transactions   map[uint64]*Transaction
 	transactionsMu sync.Mutex
+	indexes        map[string]*btree // Open indexes by index file path
+	indexesMu      sync.Mutex
+	versionMaps    map[string]*versionMap // Latest versions by table file path
+	versionsMu     sync.Mutex
+	retention      int64 // History retention in nanoseconds, read by the cleanup worker
+	locks          *lockManager
+	lockTimeout    int64                      // How long transactions wait for a lock in nanoseconds
+	migrations     map[TableID]*migrationTask // Migrations running in the background by table
+	migrationsMu   sync.Mutex
+	sequences      map[TableID]*tableSequences // Serial field state by table
+	sequencesMu    sync.Mutex
+	generations    map[TableID]int         // Generation of the files of tables that were compacted since the database was opened
+	readers        map[tableGeneration]int // Number of reads that run on the files of a generation
+	generationsMu  sync.Mutex
+	snapshots      map[uint64]int64 // Snapshots of the active transactions by transaction ID, cleanup keeps what they read
+	snapshotsMu    sync.Mutex
 }
 
+// defaultLockTimeout is how long transactions wait for a lock unless SetLockTimeout is used
+const defaultLockTimeout = 10 * time.Second
+
 // NewTableManager creates a new table manager
 func NewTableManager(db *HTDB) *TableManager {
 	return &TableManager{
 		db:           db,
 		transactions: make(map[uint64]*Transaction),
+		indexes:      make(map[string]*btree),
+		versionMaps:  make(map[string]*versionMap),
+		locks:        newLockManager(),
+		lockTimeout:  int64(defaultLockTimeout),
+		migrations:   make(map[TableID]*migrationTask),
+		sequences:    make(map[TableID]*tableSequences),
+		generations:  make(map[TableID]int),
+		readers:      make(map[tableGeneration]int),
+		snapshots:    make(map[uint64]int64),
 	}
 }
 
 // StartCleanupWorker starts the background cleanup worker
 func (tm *TableManager) StartCleanupWorker(interval time.Duration) error {
+	if err := tm.db.checkWritable(); err != nil {
+		return err
+	}
+
 	if tm.cleanupWorker != nil {
 		return fmt.Errorf("cleanup worker is already running")
 	}
@@ -37,6 +70,37 @@ func (tm *TableManager) StartCleanupWorker(interval time.Duration) error {
 	return tm.cleanupWorker.Start()
 }
 
+// SetHistoryRetention sets how long replaced and deleted versions are kept by the cleanup worker
+// AsOf queries and History can only see versions within this window, the default of 0 keeps no history
+func (tm *TableManager) SetHistoryRetention(retention time.Duration) error {
+	if retention < 0 {
+		return NewResponse(StatusBadRequest, "History retention can't be negative")
+	}
+
+	atomic.StoreInt64(&tm.retention, int64(retention))
+	return nil
+}
+
+// HistoryRetention returns how long replaced and deleted versions are kept by the cleanup worker
+func (tm *TableManager) HistoryRetention() time.Duration {
+	return time.Duration(atomic.LoadInt64(&tm.retention))
+}
+
+// SetLockTimeout sets how long transactions wait for a lock that is held by another transaction
+func (tm *TableManager) SetLockTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return NewResponse(StatusBadRequest, "Lock timeout has to be positive")
+	}
+
+	atomic.StoreInt64(&tm.lockTimeout, int64(timeout))
+	return nil
+}
+
+// LockTimeout returns how long transactions wait for a lock that is held by another transaction
+func (tm *TableManager) LockTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&tm.lockTimeout))
+}
+
 // StopCleanupWorker stops the background cleanup worker
 func (tm *TableManager) StopCleanupWorker() error {
 	if tm.cleanupWorker == nil {
@@ -63,39 +127,51 @@ func (tm *TableManager) BeginTransaction() *Transaction {
 }
 
 // CommitTransaction commits a transaction
+// The commit runs outside of the transaction list, so other transactions can begin and end in the meantime
 func (tm *TableManager) CommitTransaction(tx *Transaction) error {
-	tm.transactionsMu.Lock()
-	defer tm.transactionsMu.Unlock()
-
-	if _, exists := tm.transactions[tx.ID]; !exists {
+	if !tm.hasTransaction(tx) {
 		return fmt.Errorf("transaction not found")
 	}
 
 	err := tx.Commit()
-	if err != nil {
-		return err
-	}
 
-	delete(tm.transactions, tx.ID)
-	return nil
+	// Transactions that were rolled back because of a conflict are done as well
+	if err == nil || tx.done() {
+		tm.removeTransaction(tx)
+	}
+	return err
 }
 
 // RollbackTransaction rolls back a transaction
 func (tm *TableManager) RollbackTransaction(tx *Transaction) error {
-	tm.transactionsMu.Lock()
-	defer tm.transactionsMu.Unlock()
-
-	if _, exists := tm.transactions[tx.ID]; !exists {
+	if !tm.hasTransaction(tx) {
 		return fmt.Errorf("transaction not found")
 	}
 
 	err := tx.Rollback()
-	if err != nil {
-		return err
+
+	// Transactions that were rolled back because of a deadlock or conflict are done as well
+	if err == nil || tx.done() {
+		tm.removeTransaction(tx)
 	}
+	return err
+}
+
+// hasTransaction checks if a transaction was begun by the table manager and did not end yet
+func (tm *TableManager) hasTransaction(tx *Transaction) bool {
+	tm.transactionsMu.Lock()
+	defer tm.transactionsMu.Unlock()
+
+	_, exists := tm.transactions[tx.ID]
+	return exists
+}
+
+// removeTransaction removes a transaction that ended from the list
+func (tm *TableManager) removeTransaction(tx *Transaction) {
+	tm.transactionsMu.Lock()
+	defer tm.transactionsMu.Unlock()
 
 	delete(tm.transactions, tx.ID)
-	return nil
 }
 
 // CreateTable creates a new table
@@ -113,17 +189,58 @@ func (tm *TableManager) CreateTable(schemaName, tableName string, fields []Field
 	}
 
 	// Get the table
+	return tm.GetTable(schemaName, tableName)
+}
+
+// GetTable gets a table by name
+func (tm *TableManager) GetTable(schemaName, tableName string) (*Table, error) {
 	table, err := GetTable(schemaName+":"+tableName, tm.db.GetMainPath())
 	if err != nil {
 		return nil, err
 	}
 
+	table.db = tm.db
 	return table, nil
 }
 
-// GetTable gets a table by name
-func (tm *TableManager) GetTable(schemaName, tableName string) (*Table, error) {
-	return GetTable(schemaName+":"+tableName, tm.db.GetMainPath())
+// Table gets a table by its schema:table name, names without a schema are looked up in the default schema
+func (tm *TableManager) Table(name string) (*Table, error) {
+	id, err := tm.db.ResolveTable(name)
+	if err != nil {
+		return nil, err
+	}
+	return tm.GetTable(id.Schema, id.Table)
+}
+
+// ListTables returns the names of all tables in a schema
+func (tm *TableManager) ListTables(schemaName string) ([]string, error) {
+	schema, err := tm.db.Schema(schemaName)
+	if err != nil {
+		return nil, err
+	}
+
+	return schema.ListTables()
+}
+
+// DropTable removes a table with its records, ref field data and indexes
+// It fails while a transaction holds a lock on the table
+func (tm *TableManager) DropTable(schemaName, tableName string) error {
+	schema, err := tm.db.Schema(schemaName)
+	if err != nil {
+		return err
+	}
+
+	return schema.DropTable(tableName)
+}
+
+// RenameTable renames a table, it fails while a transaction holds a lock on the table
+func (tm *TableManager) RenameTable(schemaName, oldName, newName string) error {
+	schema, err := tm.db.Schema(schemaName)
+	if err != nil {
+		return err
+	}
+
+	return schema.RenameTable(oldName, newName)
 }
 
 // InsertRecord inserts a new record into a table
@@ -138,9 +255,12 @@ func (tm *TableManager) InsertRecord(table *Table, data map[string]interface{})
 		return nil, err
 	}
 
-	// Commit the transaction
+	// Commit the transaction, a failed commit must not keep the row locks
 	err = tm.CommitTransaction(tx)
 	if err != nil {
+		if tx.Status == TransactionActive {
+			tm.RollbackTransaction(tx)
+		}
 		return nil, err
 	}
 
@@ -148,41 +268,58 @@ func (tm *TableManager) InsertRecord(table *Table, data map[string]interface{})
 }
 
 // UpdateRecord updates an existing record in a table
+// The updates are applied to the current version of the record's row
 func (tm *TableManager) UpdateRecord(table *Table, record *Record, updates map[string]interface{}) (*Record, error) {
+	current, err := tm.currentVersion(table, record)
+	if err != nil {
+		return nil, err
+	}
+
 	// Begin a transaction
 	tx := tm.BeginTransaction()
 
 	// Stage the update
-	updatedRecord, err := tx.StageUpdate(table, record, updates)
+	updatedRecord, err := tx.StageUpdate(table, current, updates)
 	if err != nil {
 		tm.RollbackTransaction(tx)
 		return nil, err
 	}
 
-	// Commit the transaction
+	// Commit the transaction, a failed commit must not keep the row locks
 	err = tm.CommitTransaction(tx)
 	if err != nil {
+		if tx.Status == TransactionActive {
+			tm.RollbackTransaction(tx)
+		}
 		return nil, err
 	}
 
 	return updatedRecord, nil
 }
 
-// DeleteRecord deletes a record from a table
+// DeleteRecord deletes the row of a record from a table
 func (tm *TableManager) DeleteRecord(table *Table, record *Record) error {
+	current, err := tm.currentVersion(table, record)
+	if err != nil {
+		return err
+	}
+
 	// Begin a transaction
 	tx := tm.BeginTransaction()
 
 	// Stage the delete
-	err := tx.StageDelete(table, record)
+	err = tx.StageDelete(table, current)
 	if err != nil {
 		tm.RollbackTransaction(tx)
 		return err
 	}
 
-	// Commit the transaction
+	// Commit the transaction, a failed commit must not keep the row locks
 	err = tm.CommitTransaction(tx)
 	if err != nil {
+		if tx.Status == TransactionActive {
+			tm.RollbackTransaction(tx)
+		}
 		return err
 	}
 
@@ -191,12 +328,18 @@ func (tm *TableManager) DeleteRecord(table *Table, record *Record) error {
 
 // GetAllRecords gets all records from a table
 func (tm *TableManager) GetAllRecords(table *Table) ([]*Record, error) {
-	return table.GetAllRecords()
+	table, release := tm.pin(table)
+	defer release()
+
+	return table.readAllRecords()
 }
 
 // GetCurrentRecords gets all current (not deleted) records from a table
 func (tm *TableManager) GetCurrentRecords(table *Table) ([]*Record, error) {
-	records, err := table.GetAllRecords()
+	table, release := tm.pin(table)
+	defer release()
+
+	records, err := table.readAllRecords()
 	if err != nil {
 		return nil, err
 	}
@@ -211,18 +354,48 @@ func (tm *TableManager) GetCurrentRecords(table *Table) ([]*Record, error) {
 	return currentRecords, nil
 }
 
-// GetRecordByID gets a record by ID
+// GetRecordByID gets the current version of a row by its row key (the id field of the record)
 func (tm *TableManager) GetRecordByID(table *Table, id int64) (*Record, error) {
-	records, err := table.GetAllRecords()
+	table, release := tm.pin(table)
+	defer release()
+
+	head, exists, err := tm.headVersion(table, id)
 	if err != nil {
 		return nil, err
 	}
+	if !exists {
+		return nil, NewResponse(StatusRecordNotFound, "Record not found")
+	}
 
-	for _, record := range records {
-		if record.ID == id && record.Metadata.IsCurrent {
-			return record, nil
-		}
+	records, err := tm.recordsAt(table, []int64{head.pos})
+	if err != nil {
+		return nil, err
+	}
+
+	// Another version at the position means the table file was replaced after the versions were read
+	if records[0].RowKey != id || records[0].ID != head.id {
+		tm.dropVersions(table)
+		return nil, fmt.Errorf("version %d of row %d is not at position %d of table '%s'", head.id, id, head.pos, table.TableName)
+	}
+
+	if records[0].Metadata.IsDeleted {
+		return nil, NewResponse(StatusRecordNotFound, "Record not found")
+	}
+
+	return records[0], nil
+}
+
+// currentVersion returns the current version of the row a record belongs to
+func (tm *TableManager) currentVersion(table *Table, record *Record) (*Record, error) {
+	current, err := tm.GetRecordByID(table, record.RowKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The caller's copy is the current version, unless it was read before a compaction moved its ref values
+	if current.ID == record.ID && current.generation == record.generation {
+		return record, nil
 	}
 
-	return nil, fmt.Errorf("record not found")
+	return current, nil
 }
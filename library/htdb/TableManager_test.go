@@ -0,0 +1,127 @@
+package htdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetRecordByIDChecksTheRowAtThePosition(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+
+	first, err := tm.InsertRecord(table, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.GetRecordByID(table, first.RowKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The table file is replaced behind the back of the version map, the rows swap their positions
+	records, err := table.GetAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records[0], records[1] = records[1], records[0]
+	if err := table.WriteRecords(records); err != nil {
+		t.Fatal(err)
+	}
+
+	if record, err := tm.GetRecordByID(table, first.RowKey); err == nil {
+		t.Fatalf("got row %d for row %d", record.RowKey, first.RowKey)
+	}
+
+	// The versions are read again on the next lookup
+	record, err := tm.GetRecordByID(table, first.RowKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.RowKey != first.RowKey {
+		t.Fatalf("got row %d for row %d", record.RowKey, first.RowKey)
+	}
+}
+
+func TestTransactionsBeginWhileACommitWaits(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+
+	tx := tm.BeginTransaction()
+	if _, err := tx.StageInsert(table, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another commit is running, so this one waits
+	db.commitMu.Lock()
+	committed := make(chan error)
+	go func() { committed <- tm.CommitTransaction(tx) }()
+	time.Sleep(20 * time.Millisecond)
+
+	ended := make(chan error)
+	go func() {
+		other := tm.BeginTransaction()
+		ended <- tm.RollbackTransaction(other)
+	}()
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		db.commitMu.Unlock()
+		<-committed
+		t.Fatal("a transaction could not begin and end while a commit was waiting")
+	}
+
+	db.commitMu.Unlock()
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.CommitTransaction(tx); err == nil {
+		t.Fatal("a committed transaction was committed again")
+	}
+}
+
+func TestTransactionsEndWhileCloseWaitsForACommit(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+
+	tx := tm.BeginTransaction()
+	if _, err := tx.StageInsert(table, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	other := tm.BeginTransaction()
+
+	// The commit waits for another one, Close waits for the commit before it rolls it back
+	db.commitMu.Lock()
+	committed := make(chan error)
+	go func() { committed <- tm.CommitTransaction(tx) }()
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan error)
+	go func() { closed <- db.Close() }()
+	time.Sleep(20 * time.Millisecond)
+
+	ended := make(chan error)
+	go func() { ended <- tm.RollbackTransaction(other) }()
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		db.commitMu.Unlock()
+		<-committed
+		<-closed
+		t.Fatal("a transaction could not end while Close waited for a commit")
+	}
+
+	db.commitMu.Unlock()
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+}
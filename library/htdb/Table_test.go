@@ -0,0 +1,236 @@
+package htdb
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB opens a database in dir for writing, it is closed when the test ends
+func openTestDB(t *testing.T, dir string) *HTDB {
+	t.Helper()
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createTestTable creates a schema and a table in it and returns the table loaded through the table manager
+func createTestTable(t *testing.T, db *HTDB, name string, fields []Field) *Table {
+	t.Helper()
+	schema, err := db.CreateSchema("test")
+	if err != nil {
+		schema, err = db.Schema("test")
+	}
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	if response := schema.CreateTable(name, fields); response.StatusCode != 200 {
+		t.Fatalf("failed to create table: %v", response)
+	}
+	table, err := db.GetTableManager().GetTable("test", name)
+	if err != nil {
+		t.Fatalf("failed to load table: %v", err)
+	}
+	return table
+}
+
+func TestCreateTableRemovesFilesWhenCatalogFails(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	schema, err := db.CreateSchema("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in place of the temporary catalog file makes the catalog update fail
+	blocker := catalogPath(schema.schemaPath) + ".temp"
+	if err := os.MkdirAll(filepath.Join(blocker, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []Field{{Name: "name", Type: String, Length: 16, Constraints: []Constraint{Unique}}, {Name: "notes", Type: "ref", Length: 128}}
+	if response := schema.CreateTable("a", fields); response.StatusCode == 200 {
+		t.Fatal("table was created without a catalog entry")
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(schema.schemaPath, "a.*"))
+	if len(leftovers) != 0 {
+		t.Fatalf("files of the failed table were left behind: %v", leftovers)
+	}
+
+	// Once the catalog can be written the table can be created again
+	os.RemoveAll(blocker)
+	if response := schema.CreateTable("a", fields); response.StatusCode != 200 {
+		t.Fatalf("failed to create table after the failure: %v", response)
+	}
+}
+
+func TestUpgradeAbortsOnInvalidRefOffsets(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := createTestTable(t, db, "notes", []Field{{Name: "text", Type: "ref", Length: 128}})
+	if _, err := db.GetTableManager().InsertRecord(table, map[string]interface{}{"text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A version 4 table whose record points behind the end of the ref file
+	records, err := table.GetAllRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records[0].RefOffsets["text"] = [2]int64{0, 50}
+	if err := table.WriteRecords(records); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(table.refPath("text"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table.FormatVersion = 4
+	if err := table.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := Open(dir, Options{}); err == nil {
+		db.Close()
+		t.Fatal("table with invalid ref offsets was upgraded")
+	}
+
+	stored, err := GetTable("test:notes", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FormatVersion != 4 {
+		t.Fatalf("format version changed to %d after the upgrade failed", stored.FormatVersion)
+	}
+	if data, _ := os.ReadFile(table.refPath("text")); string(data) != "hello" {
+		t.Fatalf("ref file changed to %q after the upgrade failed", data)
+	}
+}
+
+func TestUpgradeCountsReferencesToDedupValues(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := createTestTable(t, db, "notes", []Field{{Name: "text", Type: "ref", Length: 128, Dedup: true}})
+	for _, text := range []string{"a", "a", "b"} {
+		if _, err := db.GetTableManager().InsertRecord(table, map[string]interface{}{"text": text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// A version 5 hash file lists the values without counts
+	data, err := os.ReadFile(refHashPath(table.refPath("text")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old []byte
+	for offset := 0; offset+refContentEntrySize <= len(data); offset += refContentEntrySize {
+		old = append(old, data[offset:offset+sha256.Size+16]...)
+	}
+	if err := os.WriteFile(refHashPath(table.refPath("text")), old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	table.FormatVersion = 5
+	if err := table.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, dir)
+	stored, err := GetTable("test:notes", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FormatVersion != tableFormatVersion {
+		t.Fatalf("table was not upgraded, format version %d", stored.FormatVersion)
+	}
+	counts := refCounts(t, stored, "text")
+	if len(counts) != 2 || counts[sha256.Sum256([]byte("a"))] != 2 || counts[sha256.Sum256([]byte("b"))] != 1 {
+		t.Fatalf("upgraded hash file has the counts %v", counts)
+	}
+
+	// The upgraded hash file is used for new values
+	size := func() int64 {
+		stat, err := os.Stat(stored.refPath("text"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.Size()
+	}
+	before := size()
+	if _, err := db.GetTableManager().InsertRecord(stored, map[string]interface{}{"text": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if size() != before {
+		t.Fatalf("ref file grew from %d to %d bytes for a stored value", before, size())
+	}
+	if count := refCounts(t, stored, "text")[sha256.Sum256([]byte("b"))]; count != 2 {
+		t.Fatalf("value is counted %d times after an insert, want 2", count)
+	}
+}
+
+func TestTablesWithTheSameNameInDifferentSchemas(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	var tables []*Table
+	for _, name := range []string{"s1", "s2"} {
+		schema, err := db.CreateSchema(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response := schema.CreateTable("items", []Field{{Name: "n", Type: Int, Length: 8}}); response.StatusCode != 200 {
+			t.Fatalf("failed to create table: %v", response)
+		}
+		table, err := tm.GetTable(name, "items")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+
+	// One transaction stages rows in both tables, each row ends up in its own table
+	tx := tm.BeginTransaction()
+	for i, table := range tables {
+		if _, err := tx.StageInsert(table, map[string]interface{}{"n": i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tm.CommitTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	for i, table := range tables {
+		records, err := tm.Select(table).GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].FieldsData["n"] != int64(i+1) {
+			t.Fatalf("table %s has %d records, want only the one staged for it", table.ID(), len(records))
+		}
+	}
+
+	// Names without a schema only resolve with a default schema
+	if _, err := db.ResolveTable("items"); err == nil {
+		t.Fatal("a table name without a schema was resolved without a default schema")
+	}
+	db.SetDefaultSchema("s2")
+	id, err := db.ResolveTable("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != tables[1].ID() {
+		t.Fatalf("items resolved to %s, want %s", id, tables[1].ID())
+	}
+	if id, err := db.ResolveTable("s1:items"); err != nil || id != tables[0].ID() {
+		t.Fatalf("s1:items resolved to %s (%v), want %s", id, err, tables[0].ID())
+	}
+}
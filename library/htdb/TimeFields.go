@@ -0,0 +1,110 @@
+// TimeFields.go
+// Description: Date, timestamp and duration fields for the HTDB library
+// All three are stored as 8 byte integers: days since the Unix epoch, nanoseconds since the Unix epoch in UTC
+// and nanoseconds. Records hold them as time.Time and time.Duration
+// Author: harto.dev
+
+package htdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// isTimeField checks if a field is a date, timestamp or duration field
+func isTimeField(field Field) bool {
+	return field.Type == Date || field.Type == Timestamp || field.Type == Duration
+}
+
+// normalizeTimeValue converts a value to the type that is stored for a time field
+// Timestamps are normalized to UTC, dates to midnight UTC of the day in the location of the value
+func normalizeTimeValue(field Field, value interface{}) (interface{}, string) {
+	switch field.Type {
+	case Date:
+		t, ok := value.(time.Time)
+		if !ok {
+			return nil, fmt.Sprintf("requires a time.Time value, got %T", value)
+		}
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), ""
+	case Timestamp:
+		t, ok := value.(time.Time)
+		if !ok {
+			return nil, fmt.Sprintf("requires a time.Time value, got %T", value)
+		}
+		// Nanoseconds since the epoch only reach from 1677 to 2262
+		if t.Year() < 1678 || t.Year() > 2261 {
+			return nil, "is outside of the range of a timestamp (1678 to 2261)"
+		}
+		return t.UTC(), ""
+	case Duration:
+		d, ok := value.(time.Duration)
+		if !ok {
+			return nil, fmt.Sprintf("requires a time.Duration value, got %T", value)
+		}
+		return d, ""
+	}
+
+	return nil, fmt.Sprintf("has unsupported type '%s'", field.Type)
+}
+
+// timeFieldToInt64 returns the stored integer of a time field value
+func timeFieldToInt64(field Field, value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		if field.Type == Date {
+			return floorDiv(v.Unix(), 86400), true
+		}
+		if field.Type == Timestamp {
+			return v.UnixNano(), true
+		}
+	case time.Duration:
+		if field.Type == Duration {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+// timeFieldFromInt64 returns the value of a time field from its stored integer
+func timeFieldFromInt64(field Field, v int64) interface{} {
+	switch field.Type {
+	case Date:
+		return time.Unix(v*86400, 0).UTC()
+	case Timestamp:
+		return time.Unix(0, v).UTC()
+	}
+	return time.Duration(v)
+}
+
+// parseTimeDefault reads the default value of a time field that was stored as JSON
+// time.Time is stored as an RFC 3339 string and time.Duration as a number of nanoseconds
+func parseTimeDefault(field Field, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case int64:
+		return time.Duration(v), nil
+	}
+	return value, nil
+}
+
+// floorDiv divides and rounds towards negative infinity, so days before the epoch are counted correctly
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+// timeGoType returns the name of the Go type a time field holds
+func timeGoType(field Field) string {
+	if field.Type == Duration {
+		return "time.Duration"
+	}
+	return "time.Time"
+}
@@ -0,0 +1,60 @@
+package htdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeFieldsRoundTrip(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "day", Type: Date, Length: 8},
+		{Name: "at", Type: Timestamp, Length: 8},
+		{Name: "took", Type: Duration, Length: 8},
+	})
+
+	zone := time.FixedZone("UTC+10", 10*60*60)
+	values := []struct {
+		day  time.Time
+		at   time.Time
+		took time.Duration
+	}{
+		{time.Date(2024, 3, 5, 1, 0, 0, 0, zone), time.Date(2024, 3, 5, 1, 2, 3, 4, zone), 90 * time.Minute},
+		{time.Date(1960, 1, 1, 23, 0, 0, 0, time.UTC), time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC), -time.Second},
+	}
+	for _, v := range values {
+		if _, err := tm.InsertRecord(table, map[string]interface{}{"day": v.day, "at": v.at, "took": v.took}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dates keep the day of the value, timestamps the instant, both are read in UTC
+	records, err := tm.Select(table).Sort("at", true).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, record := range records {
+		v := values[len(values)-1-i]
+		wantDay := time.Date(v.day.Year(), v.day.Month(), v.day.Day(), 0, 0, 0, 0, time.UTC)
+		if day := record.FieldsData["day"].(time.Time); !day.Equal(wantDay) || day.Location() != time.UTC {
+			t.Fatalf("date reads as %v, want %v", day, wantDay)
+		}
+		if at := record.FieldsData["at"].(time.Time); !at.Equal(v.at) || at.Location() != time.UTC {
+			t.Fatalf("timestamp reads as %v, want %v", at, v.at)
+		}
+		if took := record.FieldsData["took"]; took != v.took {
+			t.Fatalf("duration reads as %v, want %v", took, v.took)
+		}
+	}
+
+	if count, err := tm.Select(table).Where("took", ">", time.Duration(0)).Count(); err != nil || count != 1 {
+		t.Fatalf("took > 0 matches %d records (%v), want 1", count, err)
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"at": time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)}); err == nil {
+		t.Fatal("a timestamp outside of the stored range was accepted")
+	}
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"took": 5}); err == nil {
+		t.Fatal("an int was stored in a duration field")
+	}
+}
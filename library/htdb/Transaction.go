@@ -6,7 +6,9 @@
 package htdb
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,13 +16,15 @@ import (
 
 // Transaction represents a database transaction
 type Transaction struct {
-	ID            uint64               // Unique transaction ID
-	StartTime     time.Time            // When the transaction started
-	Status        TransactionStatus    // Current status of the transaction
-	LockedRecords map[string]int64     // Map of tableName:recordID for locked records
-	StagedRecords map[string][]*Record // Map of tableName:records for staged changes
-	db            *HTDB                // Reference to the database
-	mu            sync.Mutex           // Mutex for concurrent access
+	ID            uint64                // Unique transaction ID
+	StartTime     time.Time             // When the transaction started
+	Snapshot      int64                 // Commit timestamp of the snapshot the transaction reads
+	Status        TransactionStatus     // Current status of the transaction
+	LockedRecords map[string]int64      // Map of schema:table:rowKey for locked rows
+	StagedRecords map[TableID][]*Record // Staged changes by table
+	layouts       map[TableID]int       // Layout version of every table with staged changes
+	db            *HTDB                 // Reference to the database
+	mu            sync.Mutex            // Mutex for concurrent access
 }
 
 // TransactionStatus represents the status of a transaction
@@ -37,44 +41,110 @@ var transactionCounter uint64 = 0
 
 // NewTransaction creates a new transaction
 func NewTransaction(db *HTDB) *Transaction {
-	return &Transaction{
+	tx := &Transaction{
 		ID:            atomic.AddUint64(&transactionCounter, 1),
 		StartTime:     time.Now(),
 		Status:        TransactionActive,
 		LockedRecords: make(map[string]int64),
-		StagedRecords: make(map[string][]*Record),
+		StagedRecords: make(map[TableID][]*Record),
+		layouts:       make(map[TableID]int),
 		db:            db,
 	}
+	tx.Snapshot = db.GetTableManager().openSnapshot(tx.ID)
+	return tx
 }
 
-// LockRecord locks a record for this transaction
+// LockRecord locks a record exclusively for this transaction
+// It waits for other transactions up to the lock timeout of the table manager
 func (tx *Transaction) LockRecord(table *Table, record *Record) error {
+	ctx, cancel := tx.lockContext()
+	defer cancel()
+
+	return tx.LockRecordContext(ctx, table, record, LockExclusive)
+}
+
+// LockRecordContext locks the row of a record for this transaction and waits until the context is done
+func (tx *Transaction) LockRecordContext(ctx context.Context, table *Table, record *Record, mode LockMode) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.lockInternal(ctx, table, lockTarget{table: table.ID(), rowKey: record.RowKey}, mode)
+}
+
+// LockTable locks a whole table for this transaction
+// It waits for other transactions up to the lock timeout of the table manager
+func (tx *Transaction) LockTable(table *Table, mode LockMode) error {
+	ctx, cancel := tx.lockContext()
+	defer cancel()
+
+	return tx.LockTableContext(ctx, table, mode)
+}
+
+// LockTableContext locks a whole table for this transaction and waits until the context is done
+func (tx *Transaction) LockTableContext(ctx context.Context, table *Table, mode LockMode) error {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
-	return tx.lockRecordInternal(table, record)
+	return tx.lockInternal(ctx, table, lockTarget{table: table.ID(), whole: true}, mode)
 }
 
-// lockRecordInternal locks a record without acquiring the transaction mutex
+// lockRow locks a row exclusively without acquiring the transaction mutex
 // This is used internally by methods that already hold the transaction mutex
-func (tx *Transaction) lockRecordInternal(table *Table, record *Record) error {
+func (tx *Transaction) lockRow(table *Table, rowKey int64) error {
+	ctx, cancel := tx.lockContext()
+	defer cancel()
+
+	return tx.lockInternal(ctx, table, lockTarget{table: table.ID(), rowKey: rowKey}, LockExclusive)
+}
+
+// lockInternal acquires a lock from the lock manager, the caller holds the transaction mutex
+// A transaction that is chosen as the victim of a deadlock is rolled back
+func (tx *Transaction) lockInternal(ctx context.Context, table *Table, target lockTarget, mode LockMode) error {
 	if tx.Status != TransactionActive {
 		return fmt.Errorf("transaction is not active")
 	}
 
-	// Try to lock the record
-	err := record.Lock(tx.ID)
+	err := tx.db.GetTableManager().locks.acquire(ctx, tx.ID, target, mode)
 	if err != nil {
+		if response, ok := err.(Response); ok && response.StatusCode == StatusDeadlock {
+			tx.rollbackInternal()
+		}
 		return err
 	}
 
-	// Add to locked records
-	key := fmt.Sprintf("%s:%d", table.TableName, record.ID)
-	tx.LockedRecords[key] = record.ID
+	if !target.whole {
+		key := fmt.Sprintf("%s:%d", table.ID(), target.rowKey)
+		tx.LockedRecords[key] = target.rowKey
+	}
 
 	return nil
 }
 
+// lockContext returns a context that ends after the lock timeout of the table manager
+func (tx *Transaction) lockContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), tx.db.GetTableManager().LockTimeout())
+}
+
+// releaseLocks releases all row and table locks of this transaction
+func (tx *Transaction) releaseLocks() {
+	tx.db.GetTableManager().locks.releaseAll(tx.ID)
+}
+
+// done checks if the transaction was committed or rolled back
+func (tx *Transaction) done() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.Status != TransactionActive
+}
+
+// finish ends the transaction, it releases its locks and its snapshot
+func (tx *Transaction) finish(status TransactionStatus) {
+	tx.Status = status
+	tx.releaseLocks()
+	tx.db.GetTableManager().closeSnapshot(tx.ID)
+}
+
 // StageUpdate stages an update to a record
 func (tx *Transaction) StageUpdate(table *Table, record *Record, updates map[string]interface{}) (*Record, error) {
 	tx.mu.Lock()
@@ -84,13 +154,37 @@ func (tx *Transaction) StageUpdate(table *Table, record *Record, updates map[str
 		return nil, fmt.Errorf("transaction is not active")
 	}
 
-	// Lock the record if not already locked
-	key := fmt.Sprintf("%s:%d", table.TableName, record.ID)
-	if _, exists := tx.LockedRecords[key]; !exists {
-		err := tx.lockRecordInternal(table, record)
-		if err != nil {
-			return nil, err
-		}
+	if err := tx.db.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.trackLayout(table); err != nil {
+		return nil, err
+	}
+
+	// Validate the updates against the table fields
+	updates, err := validateData(table, updates, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the row, other transactions that change it have to wait
+	err = tx.lockRow(table, record.RowKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compactions wait for the row lock, so the files of the table stay the same until the transaction ends
+	table = tx.db.GetTableManager().current(table)
+
+	// Changes to a row this transaction already changed build on the staged version
+	if staged := tx.stagedVersion(table, record.RowKey); staged != nil {
+		record = staged
+	}
+
+	// The ref offsets of a record read before a compaction point into the old files
+	if record.generation != table.Generation {
+		return nil, tableCompacted(table.TableName)
 	}
 
 	// Create a staging copy
@@ -101,20 +195,7 @@ func (tx *Transaction) StageUpdate(table *Table, record *Record, updates map[str
 
 	// Apply updates
 	for field, value := range updates {
-		// Check if field exists in the table schema
-		fieldExists := false
-		var fieldDef Field
-		for _, f := range table.Fields {
-			if f.Name == field {
-				fieldExists = true
-				fieldDef = f
-				break
-			}
-		}
-
-		if !fieldExists {
-			return nil, fmt.Errorf("field '%s' does not exist in table '%s'", field, table.TableName)
-		}
+		fieldDef, _ := table.getField(field)
 
 		// Handle ref fields specially
 		if fieldDef.Type == "ref" {
@@ -129,7 +210,7 @@ func (tx *Transaction) StageUpdate(table *Table, record *Record, updates map[str
 				}
 
 				// Store the value in the ref file
-				err := staging.WriteRefData(table.SchemaPath, table.TableName, field, strValue)
+				err := staging.writeRefStream(table.SchemaPath, table.TableName, fieldDef, strings.NewReader(strValue))
 				if err != nil {
 					return nil, err
 				}
@@ -137,6 +218,19 @@ func (tx *Transaction) StageUpdate(table *Table, record *Record, updates map[str
 				staging.FieldsData[field] = strValue
 				staging.FieldsMeta[field] = FieldMetadata{IsNull: false}
 			}
+		} else if fieldDef.Type == Blob {
+			if value == nil {
+				staging.FieldsMeta[field] = FieldMetadata{IsNull: true}
+				delete(staging.RefOffsets, field)
+			} else {
+				// Blob values are streamed to their data file and not kept in the record
+				err := staging.writeRefStream(table.SchemaPath, table.TableName, fieldDef, blobSource(value))
+				if err != nil {
+					return nil, err
+				}
+				staging.FieldsMeta[field] = FieldMetadata{IsNull: false}
+			}
+			delete(staging.FieldsData, field)
 		} else {
 			// Regular field
 			if value == nil {
@@ -150,10 +244,10 @@ func (tx *Transaction) StageUpdate(table *Table, record *Record, updates map[str
 	}
 
 	// Add to staged records
-	if _, exists := tx.StagedRecords[table.TableName]; !exists {
-		tx.StagedRecords[table.TableName] = []*Record{}
+	if _, exists := tx.StagedRecords[table.ID()]; !exists {
+		tx.StagedRecords[table.ID()] = []*Record{}
 	}
-	tx.StagedRecords[table.TableName] = append(tx.StagedRecords[table.TableName], staging)
+	tx.StagedRecords[table.ID()] = append(tx.StagedRecords[table.ID()], staging)
 
 	return staging, nil
 }
@@ -167,13 +261,31 @@ func (tx *Transaction) StageDelete(table *Table, record *Record) error {
 		return fmt.Errorf("transaction is not active")
 	}
 
-	// Lock the record if not already locked
-	key := fmt.Sprintf("%s:%d", table.TableName, record.ID)
-	if _, exists := tx.LockedRecords[key]; !exists {
-		err := tx.lockRecordInternal(table, record)
-		if err != nil {
-			return err
-		}
+	if err := tx.db.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := tx.trackLayout(table); err != nil {
+		return err
+	}
+
+	// Lock the row, other transactions that change it have to wait
+	err := tx.lockRow(table, record.RowKey)
+	if err != nil {
+		return err
+	}
+
+	// Compactions wait for the row lock, so the files of the table stay the same until the transaction ends
+	table = tx.db.GetTableManager().current(table)
+
+	// Changes to a row this transaction already changed build on the staged version
+	if staged := tx.stagedVersion(table, record.RowKey); staged != nil {
+		record = staged
+	}
+
+	// The ref offsets of a record read before a compaction point into the old files
+	if record.generation != table.Generation {
+		return tableCompacted(table.TableName)
 	}
 
 	// Create a staging copy
@@ -186,16 +298,36 @@ func (tx *Transaction) StageDelete(table *Table, record *Record) error {
 	staging.Metadata.IsDeleted = true
 
 	// Add to staged records
-	if _, exists := tx.StagedRecords[table.TableName]; !exists {
-		tx.StagedRecords[table.TableName] = []*Record{}
+	if _, exists := tx.StagedRecords[table.ID()]; !exists {
+		tx.StagedRecords[table.ID()] = []*Record{}
 	}
-	tx.StagedRecords[table.TableName] = append(tx.StagedRecords[table.TableName], staging)
+	tx.StagedRecords[table.ID()] = append(tx.StagedRecords[table.ID()], staging)
 
 	return nil
 }
 
-// Global counter for generating unique IDs
-var recordIDCounter int64 = 0
+// trackLayout remembers the layout version of a table the transaction stages changes for
+// All changes of a table have to be staged with the same fields
+func (tx *Transaction) trackLayout(table *Table) error {
+	layout, exists := tx.layouts[table.ID()]
+	if exists && layout != table.LayoutVersion {
+		return tableChanged(table)
+	}
+
+	tx.layouts[table.ID()] = table.LayoutVersion
+	return nil
+}
+
+// stagedVersion returns the latest version of a row staged in this transaction
+func (tx *Transaction) stagedVersion(table *Table, rowKey int64) *Record {
+	staged := tx.StagedRecords[table.ID()]
+	for i := len(staged) - 1; i >= 0; i-- {
+		if staged[i].RowKey == rowKey {
+			return staged[i]
+		}
+	}
+	return nil
+}
 
 // StageInsert stages a new record for insertion
 func (tx *Transaction) StageInsert(table *Table, data map[string]interface{}) (*Record, error) {
@@ -206,13 +338,42 @@ func (tx *Transaction) StageInsert(table *Table, data map[string]interface{}) (*
 		return nil, fmt.Errorf("transaction is not active")
 	}
 
-	// Generate a new ID with a counter to ensure uniqueness
-	id := time.Now().UnixNano() + atomic.AddInt64(&recordIDCounter, 1)
+	if err := tx.db.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.trackLayout(table); err != nil {
+		return nil, err
+	}
+
+	// Validate the data against the table fields
+	data, err := validateData(table, data, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.db.GetTableManager().generateFields(table, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate a new ID, it becomes the row key of the record
+	id := tx.db.generateUniqueTimestamp()
+
+	// Lock the new row, this waits for transactions that lock the whole table
+	err = tx.lockRow(table, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compactions wait for the row lock, so the files of the table stay the same until the transaction ends
+	table = tx.db.GetTableManager().current(table)
 
 	// Create a new record
 	record := NewRecord(id, data)
 	record.Metadata.IsLocked = true
 	record.Metadata.TransactionID = tx.ID
+	record.generation = table.Generation
 
 	// Handle ref fields
 	for _, field := range table.Fields {
@@ -228,7 +389,21 @@ func (tx *Transaction) StageInsert(table *Table, data map[string]interface{}) (*
 			}
 
 			// Store the value in the ref file
-			err := record.WriteRefData(table.SchemaPath, table.TableName, field.Name, strValue)
+			err := record.writeRefStream(table.SchemaPath, table.TableName, field, strings.NewReader(strValue))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if field.Type == Blob {
+			value, exists := data[field.Name]
+			delete(record.FieldsData, field.Name)
+			if !exists || value == nil {
+				continue
+			}
+
+			// Blob values are streamed to their data file and not kept in the record
+			err := record.writeRefStream(table.SchemaPath, table.TableName, field, blobSource(value))
 			if err != nil {
 				return nil, err
 			}
@@ -236,10 +411,10 @@ func (tx *Transaction) StageInsert(table *Table, data map[string]interface{}) (*
 	}
 
 	// Add to staged records
-	if _, exists := tx.StagedRecords[table.TableName]; !exists {
-		tx.StagedRecords[table.TableName] = []*Record{}
+	if _, exists := tx.StagedRecords[table.ID()]; !exists {
+		tx.StagedRecords[table.ID()] = []*Record{}
 	}
-	tx.StagedRecords[table.TableName] = append(tx.StagedRecords[table.TableName], record)
+	tx.StagedRecords[table.ID()] = append(tx.StagedRecords[table.ID()], record)
 
 	return record, nil
 }
@@ -253,47 +428,181 @@ func (tx *Transaction) Commit() error {
 		return fmt.Errorf("transaction is not active")
 	}
 
-	// Process each table's staged records
-	for tableName, records := range tx.StagedRecords {
-		// Get the table
-		table, err := GetTable(tableName, tx.db.GetMainPath())
+	// Read-only transactions have nothing to write
+	if len(tx.StagedRecords) == 0 {
+		tx.finish(TransactionCommitted)
+		return nil
+	}
+
+	// Commits are applied one after another
+	tx.db.commitMu.Lock()
+	defer tx.db.commitMu.Unlock()
+
+	// Replay earlier commits that are logged but could not be applied
+	if tx.db.walDirty {
+		err := tx.db.recoverWAL()
 		if err != nil {
-			fmt.Println(err)
-			return fmt.Errorf("failed to get table '%s': %v", tableName, err)
+			return fmt.Errorf("failed to apply earlier commits: %v", err)
 		}
+		tx.db.walDirty = false
+	}
 
-		// Get existing records to update their is_current flag
-		existingRecords, err := table.GetAllRecords()
+	// Load the tables and check all constraints before anything is written
+	var tables []*Table
+	for id, records := range tx.StagedRecords {
+		// Get the table
+		table, err := GetTable(id.String(), tx.db.GetMainPath())
 		if err != nil {
-			return fmt.Errorf("failed to get existing records for table '%s': %v", tableName, err)
+			return fmt.Errorf("failed to get table '%s': %v", id, err)
 		}
 
-		// Update existing records' is_current flag
-		for _, staged := range records {
-			for _, existing := range existingRecords {
-				// If this is an update to an existing record (not a new insert)
-				if existing.FieldsData["id"] == staged.FieldsData["id"] && !staged.Metadata.IsDeleted {
-					existing.Metadata.IsCurrent = false
-				}
+		// Staged records are serialized with the fields they were validated against
+		if table.LayoutVersion != tx.layouts[id] || (table.Migration != nil && table.Migration.Applied) {
+			tx.rollbackInternal()
+			return tableChanged(table)
+		}
+
+		// The ref offsets of the records have to point into the files of the current generation
+		for _, record := range records {
+			if record.generation != table.Generation {
+				tx.rollbackInternal()
+				return tableCompacted(table.TableName)
 			}
 		}
 
-		// Mark staged records as current and not locked
+		err = tx.checkWriteConflicts(table, records)
+		if err != nil {
+			// The transaction can't be committed anymore
+			tx.rollbackInternal()
+			return err
+		}
+
+		err = tx.checkUniqueConstraints(table, records)
+		if err != nil {
+			return err
+		}
+
+		tables = append(tables, table)
+	}
+
+	// The committed versions are prepared on copies, the staged records stay as they are until the commit is logged
+	entry := walEntry{TransactionID: tx.ID}
+	var commitTimestamp int64
+	committed := make(map[*Record]*Record)
+	for _, table := range tables {
+		id := table.ID()
+		records := tx.StagedRecords[id]
+
+		// Ref values were written while staging, they have to be on disk before the commit is logged
+		err := table.syncRefFiles()
+		if err != nil {
+			return err
+		}
+
+		// The records are appended behind the existing ones
+		startPosition, err := tx.db.GetTableManager().recordCount(table)
+		if err != nil {
+			return err
+		}
+
+		wt := walTable{
+			Schema:        id.Schema,
+			Table:         id.Table,
+			StartPosition: startPosition,
+		}
+
+		// Versions get their ID when they are committed, so the IDs tell when a version became visible
+		versionIDs := make(map[int64]int64)
 		for _, record := range records {
-			record.Metadata.IsCurrent = true
-			record.Metadata.IsLocked = false
-			record.Metadata.TransactionID = 0
+			versionID := tx.db.generateUniqueTimestamp()
+			versionIDs[record.ID] = versionID
+			prevID := record.PrevID
+			if id, exists := versionIDs[record.PrevID]; exists {
+				prevID = id
+			}
+			commitTimestamp = versionID
+
+			// Committed versions are current and not locked
+			metadata := record.Metadata
+			metadata.IsCurrent = true
+			metadata.IsLocked = false
+			metadata.TransactionID = 0
+
+			version := &Record{
+				ID:         versionID,
+				Metadata:   metadata,
+				FieldsData: record.FieldsData,
+				FieldsMeta: record.FieldsMeta,
+				RefOffsets: record.RefOffsets,
+				PrevID:     prevID,
+				RowKey:     record.RowKey,
+			}
+			data, err := version.Serialize(table.Fields)
+			if err != nil {
+				return fmt.Errorf("failed to serialize record: %v", err)
+			}
+			wt.Records = append(wt.Records, data)
+			committed[record] = version
 		}
 
-		// Append all records (existing and staged) to the table file
-		err = table.WriteRecords(append(existingRecords, records...))
+		entry.Tables = append(entry.Tables, wt)
+	}
+
+	// The committed versions refer to the values of dedup fields, the counts are synced before the commit is logged
+	var counted []*Table
+	uncount := func() {
+		for _, table := range counted {
+			table.countRefValues(tx.StagedRecords[table.ID()], -1)
+		}
+	}
+	for _, table := range tables {
+		err := table.countRefValues(tx.StagedRecords[table.ID()], 1)
+		if err != nil {
+			uncount()
+			return err
+		}
+		counted = append(counted, table)
+	}
+
+	// Log the transaction, from here on the commit survives a crash
+	err := tx.db.wal.Append(entry)
+	if err != nil {
+		// A commit that is not in the log has no versions that refer to the values
+		if _, kept := err.(walEntryKept); !kept {
+			uncount()
+		}
+		return err
+	}
+
+	// The caller's records become the committed versions
+	for record, version := range committed {
+		record.ID = version.ID
+		record.PrevID = version.PrevID
+		record.Metadata = version.Metadata
+	}
+
+	// Apply the changes to the table files
+	for i, wt := range entry.Tables {
+		err := tx.db.applyWALTable(tables[i], wt)
 		if err != nil {
-			return fmt.Errorf("failed to write records to table '%s': %v", tableName, err)
+			tx.db.walDirty = true
+			tx.finish(TransactionCommitted)
+			return fmt.Errorf("transaction is committed but not yet applied, it will be replayed: %v", err)
 		}
 	}
 
+	// New transactions see this commit
+	if commitTimestamp != 0 {
+		atomic.StoreInt64(&tx.db.lastCommit, commitTimestamp)
+	}
+
+	err = tx.db.wal.Truncate()
+	if err != nil {
+		tx.db.walDirty = true
+	}
+
 	// Update transaction status
-	tx.Status = TransactionCommitted
+	tx.finish(TransactionCommitted)
 
 	return nil
 }
@@ -307,40 +616,20 @@ func (tx *Transaction) Rollback() error {
 		return fmt.Errorf("transaction is not active")
 	}
 
-	// No need to do anything with staged records, they will be ignored
-	// Just unlock any locked records
-	for tableName, _ := range tx.StagedRecords {
-		// Get the table
-		table, err := GetTable(tableName, tx.db.GetMainPath())
-		if err != nil {
-			return fmt.Errorf("failed to get table '%s': %v", tableName, err)
-		}
+	tx.rollbackInternal()
 
-		// Get existing records to unlock them
-		existingRecords, err := table.GetAllRecords()
-		if err != nil {
-			return fmt.Errorf("failed to get existing records for table '%s': %v", tableName, err)
-		}
+	return nil
+}
 
-		// Unlock records
-		for _, existing := range existingRecords {
-			if existing.Metadata.IsLocked && existing.Metadata.TransactionID == tx.ID {
-				existing.Metadata.IsLocked = false
-				existing.Metadata.TransactionID = 0
-			}
-		}
-
-		// Write the updated records back to the table
-		err = table.WriteRecords(existingRecords)
-		if err != nil {
-			return fmt.Errorf("failed to write records to table '%s': %v", tableName, err)
-		}
-	}
+// rollbackInternal rolls back the transaction without acquiring the transaction mutex
+func (tx *Transaction) rollbackInternal() {
+	// Staged records were never written to the table files, so they are simply dropped
+	tx.StagedRecords = make(map[TableID][]*Record)
+	tx.LockedRecords = make(map[string]int64)
+	tx.layouts = make(map[TableID]int)
 
 	// Update transaction status
-	tx.Status = TransactionRolledBack
-
-	return nil
+	tx.finish(TransactionRolledBack)
 }
 
 // Note: The actual implementations of GetTable, WriteRecords, and GetAllRecords
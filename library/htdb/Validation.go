@@ -0,0 +1,155 @@
+// Validation.go
+// Description: Validation of staged data for the HTDB library
+// Checks inserts and updates against the table fields before they are staged
+// Author: harto.dev
+
+package htdb
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// FieldViolation describes why the value of a field was rejected
+type FieldViolation struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ValidationError contains every violation found in the data for a table
+type ValidationError struct {
+	Response
+	Table      string           `json:"table"`
+	Violations []FieldViolation `json:"violations"`
+}
+
+// newValidationError creates the error for a list of violations
+func newValidationError(table *Table, violations []FieldViolation) ValidationError {
+	parts := make([]string, len(violations))
+	for i, v := range violations {
+		parts[i] = v.Field + ": " + v.Reason
+	}
+
+	message := fmt.Sprintf("Invalid data for table '%s': %s", table.TableName, strings.Join(parts, "; "))
+	return ValidationError{
+		Response:   NewResponse(StatusValidationFailed, message),
+		Table:      table.TableName,
+		Violations: violations,
+	}
+}
+
+// validateData checks data against the fields of a table and returns a normalized copy
+// For inserts all required fields have to be set, updates only check the given fields
+func validateData(table *Table, data map[string]interface{}, insert bool) (map[string]interface{}, error) {
+	var violations []FieldViolation
+	normalized := make(map[string]interface{}, len(data))
+
+	for _, field := range table.Fields {
+		value, exists := data[field.Name]
+
+		// The primary key, uuid and serial fields are generated by the database
+		if isGeneratedField(field) {
+			if exists {
+				violations = append(violations, FieldViolation{field.Name, "is generated and can't be set"})
+			}
+			continue
+		}
+
+		if !exists || value == nil {
+			required := field.HasConstraint(NotNull) || field.HasConstraint(PrimaryKey)
+			if required && (insert || exists) {
+				violations = append(violations, FieldViolation{field.Name, "is required"})
+			}
+			if exists {
+				normalized[field.Name] = nil
+			}
+			continue
+		}
+
+		v, reason := normalizeValue(field, value)
+		if reason != "" {
+			violations = append(violations, FieldViolation{field.Name, reason})
+			continue
+		}
+		normalized[field.Name] = v
+	}
+
+	// Keys that are not part of the table
+	var unknown []string
+	for name := range data {
+		if _, exists := table.getField(name); !exists {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		violations = append(violations, FieldViolation{name, "does not exist in the table"})
+	}
+
+	if len(violations) > 0 {
+		return nil, newValidationError(table, violations)
+	}
+
+	return normalized, nil
+}
+
+// normalizeValue converts a value to the type that is stored for a field
+// It returns a reason if the value can't be stored in the field
+func normalizeValue(field Field, value interface{}) (interface{}, string) {
+	switch field.Type {
+	case Int:
+		if v, ok := value.(uint64); ok && v > math.MaxInt64 {
+			return nil, "is too large for an int"
+		}
+		if v, ok := value.(uint); ok && uint64(v) > math.MaxInt64 {
+			return nil, "is too large for an int"
+		}
+		v, ok := toInt64(value)
+		if !ok {
+			return nil, fmt.Sprintf("requires an integer value, got %T", value)
+		}
+		return v, ""
+	case Float:
+		v, ok := toFloat64(value)
+		if !ok {
+			return nil, fmt.Sprintf("requires a number value, got %T", value)
+		}
+		return v, ""
+	case String:
+		v, ok := value.(string)
+		if !ok {
+			return nil, fmt.Sprintf("requires a string value, got %T", value)
+		}
+		if len(v) > int(field.Length) {
+			return nil, fmt.Sprintf("is %d bytes long, the maximum is %d", len(v), field.Length)
+		}
+		return v, ""
+	case Bool:
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Sprintf("requires a bool value, got %T", value)
+		}
+		return v, ""
+	case Decimal:
+		return normalizeDecimal(field, value)
+	case Date, Timestamp, Duration:
+		return normalizeTimeValue(field, value)
+	case "ref":
+		v, ok := value.(string)
+		if !ok {
+			return nil, fmt.Sprintf("requires a string value, got %T", value)
+		}
+		return v, ""
+	case Blob:
+		switch value.(type) {
+		case []byte, io.Reader:
+			return value, ""
+		}
+		return nil, fmt.Sprintf("requires a []byte or io.Reader value, got %T", value)
+	}
+
+	return nil, fmt.Sprintf("has unsupported type '%s'", field.Type)
+}
@@ -0,0 +1,71 @@
+package htdb
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInsertReportsEveryInvalidField(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "name", Type: String, Length: 4, Constraints: []Constraint{NotNull}},
+		{Name: "n", Type: Int, Length: 8},
+		{Name: "f", Type: Float, Length: 8},
+	})
+
+	_, err := tm.InsertRecord(table, map[string]interface{}{
+		"id":    int64(1),
+		"n":     uint64(math.MaxInt64) + 1,
+		"f":     "1.5",
+		"extra": true,
+	})
+	verr, ok := err.(ValidationError)
+	if !ok || verr.StatusCode != StatusValidationFailed {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	want := []string{"id", "name", "n", "f", "extra"}
+	if len(verr.Violations) != len(want) {
+		t.Fatalf("got the violations %v, want one for each of %v", verr.Violations, want)
+	}
+	for i, v := range verr.Violations {
+		if v.Field != want[i] {
+			t.Fatalf("violation %d is for %q, want %q", i, v.Field, want[i])
+		}
+	}
+
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"name": "toolong"}); err == nil {
+		t.Fatal("a string longer than its field was stored")
+	}
+	if count, err := tm.Select(table).Count(); err != nil || count != 0 {
+		t.Fatalf("table has %d records (%v) after the rejected inserts", count, err)
+	}
+}
+
+func TestValuesAreStoredInTheTypeOfTheirField(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{
+		{Name: "name", Type: String, Length: 8, Constraints: []Constraint{NotNull}},
+		{Name: "n", Type: Int, Length: 8},
+		{Name: "f", Type: Float, Length: 8},
+	})
+
+	record, err := tm.InsertRecord(table, map[string]interface{}{"name": "a", "n": int32(7), "f": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.FieldsData["n"] != int64(7) || record.FieldsData["f"] != float64(2) {
+		t.Fatalf("values are stored as %T and %T", record.FieldsData["n"], record.FieldsData["f"])
+	}
+
+	// Updates only check the fields they change, but required fields can't be cleared
+	record, err = tm.UpdateRecord(table, record, map[string]interface{}{"n": uint8(8)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tm.UpdateRecord(table, record, map[string]interface{}{"name": nil})
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatalf("expected a ValidationError for clearing a not null field, got %v", err)
+	}
+}
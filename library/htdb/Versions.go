@@ -0,0 +1,263 @@
+// Versions.go
+// Description: Version resolution for the HTDB library
+// Table files are append-only, a version stays current until a later version of the same row is appended
+// Author: harto.dev
+
+package htdb
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// versionMap holds the latest versions of a table so commits don't have to read the table file
+type versionMap struct {
+	count int64                 // Number of records in the table file
+	heads map[int64]versionHead // Row key -> current version
+}
+
+// versionHead is the current version of a row
+type versionHead struct {
+	id  int64 // Version ID
+	pos int64 // Position in the table file
+}
+
+// versions returns the version map of a table, it is built from the table file on first use
+// The caller has to hold tm.versionsMu
+func (tm *TableManager) versions(table *Table) (*versionMap, error) {
+	if vm, exists := tm.versionMaps[table.dataPath()]; exists {
+		return vm, nil
+	}
+
+	records, err := table.readAllRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	vm := &versionMap{
+		count: int64(len(records)),
+		heads: make(map[int64]versionHead),
+	}
+	for pos, record := range records {
+		if record.Metadata.IsCurrent {
+			vm.heads[record.RowKey] = versionHead{id: record.ID, pos: int64(pos)}
+		}
+	}
+
+	tm.versionMaps[table.dataPath()] = vm
+	return vm, nil
+}
+
+// recordCount returns the number of records in the table file
+func (tm *TableManager) recordCount(table *Table) (int64, error) {
+	tm.versionsMu.Lock()
+	defer tm.versionsMu.Unlock()
+
+	vm, err := tm.versions(table)
+	if err != nil {
+		return 0, err
+	}
+	return vm.count, nil
+}
+
+// headVersion returns the current version of a row
+func (tm *TableManager) headVersion(table *Table, rowKey int64) (versionHead, bool, error) {
+	tm.versionsMu.Lock()
+	defer tm.versionsMu.Unlock()
+
+	vm, err := tm.versions(table)
+	if err != nil {
+		return versionHead{}, false, err
+	}
+
+	head, exists := vm.heads[rowKey]
+	return head, exists, nil
+}
+
+// addVersions registers records that were appended to the table file
+func (tm *TableManager) addVersions(table *Table, records []*Record, positions []int64) {
+	tm.versionsMu.Lock()
+	defer tm.versionsMu.Unlock()
+
+	vm, exists := tm.versionMaps[table.dataPath()]
+	if !exists {
+		return // Built from the table file on first use
+	}
+
+	for i, record := range records {
+		vm.heads[record.RowKey] = versionHead{id: record.ID, pos: positions[i]}
+		if positions[i] >= vm.count {
+			vm.count = positions[i] + 1
+		}
+	}
+}
+
+// dropVersions forgets the version map of a table, this is needed when the table file is rewritten
+func (tm *TableManager) dropVersions(table *Table) {
+	tm.versionsMu.Lock()
+	defer tm.versionsMu.Unlock()
+
+	delete(tm.versionMaps, table.dataPath())
+}
+
+// recordsAt reads the records at the given positions and resolves if they are current
+func (tm *TableManager) recordsAt(table *Table, positions []int64) ([]*Record, error) {
+	records, err := table.readRecordsAt(positions)
+	if err != nil {
+		return nil, err
+	}
+
+	tm.versionsMu.Lock()
+	defer tm.versionsMu.Unlock()
+
+	vm, err := tm.versions(table)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, record := range records {
+		head, exists := vm.heads[record.RowKey]
+		record.Metadata.IsCurrent = record.Metadata.IsCurrent && exists && head.pos == positions[i]
+	}
+
+	return records, nil
+}
+
+// resolveVersions marks every record that was replaced by a later version as not current
+// Records are in table file order, the last version of a row is its current one
+func resolveVersions(records []*Record) {
+	superseded := make(map[int64]bool)
+	last := make(map[int64]int)
+	for i, record := range records {
+		// Tables upgraded from the second format only know the replaced version
+		if record.PrevID != 0 {
+			superseded[record.PrevID] = true
+		}
+		last[record.RowKey] = i
+	}
+
+	for i, record := range records {
+		if superseded[record.ID] || last[record.RowKey] != i {
+			record.Metadata.IsCurrent = false
+		}
+	}
+}
+
+// appendRecords appends serialized records at a position of the table file
+// Anything behind the position is left over from an interrupted commit and gets cut off first
+func (t *Table) appendRecords(startPos int64, data []byte) error {
+	file, err := os.OpenFile(t.dataPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open table file: %v", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get table file stats: %v", err)
+	}
+
+	offset := startPos * int64(t.recordSize())
+	if stat.Size() < offset {
+		return fmt.Errorf("table file is shorter than expected (%d < %d bytes)", stat.Size(), offset)
+	}
+
+	err = file.Truncate(offset)
+	if err != nil {
+		return fmt.Errorf("failed to truncate table file: %v", err)
+	}
+
+	_, err = file.WriteAt(data, offset)
+	if err != nil {
+		return fmt.Errorf("failed to append records: %v", err)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync table file: %v", err)
+	}
+
+	return nil
+}
+
+// versionsAt returns the version of every row that was current at a timestamp
+// Version IDs are commit timestamps, so that is the latest version with an ID up to the timestamp
+// The returned records are marked as current, rows that were deleted at that time are returned as deleted
+func versionsAt(records []*Record, timestamp int64) []*Record {
+	// Replaced versions of tables from the first format have no later version and are never current
+	last := make(map[int64]*Record)
+	for _, record := range records {
+		last[record.RowKey] = record
+	}
+
+	visible := make(map[int64]*Record)
+	var order []int64
+	for _, record := range records {
+		if record.ID > timestamp || !last[record.RowKey].Metadata.IsCurrent {
+			continue
+		}
+
+		existing, exists := visible[record.RowKey]
+		if !exists {
+			order = append(order, record.RowKey)
+		}
+		if !exists || record.ID > existing.ID {
+			visible[record.RowKey] = record
+		}
+	}
+
+	result := make([]*Record, 0, len(order))
+	for _, rowKey := range order {
+		record := visible[rowKey]
+		record.Metadata.IsCurrent = true
+		result = append(result, record)
+	}
+
+	return result
+}
+
+// History returns every stored version of a row, from the oldest to the current one
+// Deleted rows end with a version that is marked as deleted
+func (tm *TableManager) History(table *Table, rowKey int64) ([]*Record, error) {
+	table, release := tm.pin(table)
+	defer release()
+
+	var records []*Record
+	var err error
+
+	// The index on the id field holds every version of a row
+	positions, ok := []int64(nil), false
+	if idField, exists := table.getField("id"); exists {
+		positions, ok, err = tm.indexCandidates(table, condition{field: idField, operator: "=", value: rowKey})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ok {
+		records, err = tm.recordsAt(table, positions)
+	} else {
+		records, err = table.readAllRecords()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []*Record
+	for _, record := range records {
+		if record.RowKey == rowKey {
+			versions = append(versions, record)
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil, NewResponse(StatusRecordNotFound, "Record not found")
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].ID < versions[j].ID
+	})
+
+	return versions, nil
+}
@@ -0,0 +1,168 @@
+package htdb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCommitsAppendToTheTableFile(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	record, err := tm.InsertRecord(table, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.ReadFile(table.dataPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := tm.BeginTransaction()
+	if _, err := tx.StageUpdate(table, record, map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.StageInsert(table, map[string]interface{}{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.CommitTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(table.dataPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+2*table.recordSize() || !bytes.Equal(after[:len(before)], before) {
+		t.Fatalf("table file went from %d to %d bytes, want the two new versions appended", len(before), len(after))
+	}
+
+	// The replaced version stays in the file, the current versions are found without rewriting it
+	check := func(tm *TableManager) {
+		t.Helper()
+		records, err := tm.GetCurrentRecords(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[int64]bool)
+		for _, record := range records {
+			values[record.FieldsData["n"].(int64)] = true
+		}
+		if len(records) != 2 || !values[2] || !values[3] {
+			t.Fatalf("current records have the values %v, want 2 and 3", values)
+		}
+	}
+	check(tm)
+	db.Close()
+	check(openTestDB(t, dir).GetTableManager())
+}
+
+func TestRowKeyStaysTheSameAcrossVersions(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+
+	first, err := tm.InsertRecord(table, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tm.UpdateRecord(table, first, map[string]interface{}{"n": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RowKey != first.RowKey || second.ID == first.ID || second.PrevID != first.ID {
+		t.Fatalf("update got row key %d, ID %d and previous ID %d, want row key %d and previous ID %d",
+			second.RowKey, second.ID, second.PrevID, first.RowKey, first.ID)
+	}
+
+	// Lookups by row key find the current version, the replaced one is no longer current
+	current, err := tm.GetRecordByID(table, first.RowKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.ID != second.ID || current.FieldsData["n"] != int64(2) {
+		t.Fatalf("row key %d resolves to version %d with n = %v, want version %d", first.RowKey, current.ID, current.FieldsData["n"], second.ID)
+	}
+	if count, err := tm.Select(table).Count(); err != nil || count != 1 {
+		t.Fatalf("table has %d current rows (%v) after the update, want 1", count, err)
+	}
+
+	// A deleted row is not found by its row key anymore
+	if err := tm.DeleteRecord(table, current); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tm.GetRecordByID(table, first.RowKey)
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusRecordNotFound {
+		t.Fatalf("expected StatusRecordNotFound for a deleted row, got %v", err)
+	}
+}
+
+func TestAsOfAndHistoryWithinTheRetentionWindow(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+
+	first, err := tm.InsertRecord(table, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tm.UpdateRecord(table, first, map[string]interface{}{"n": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.DeleteRecord(table, second); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := tm.History(table, first.RowKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].ID != first.ID || history[1].ID != second.ID || !history[2].Metadata.IsDeleted {
+		t.Fatalf("history has %d versions, want the insert, the update and the delete", len(history))
+	}
+
+	// Version IDs are commit timestamps, every point in time sees the version committed last before it
+	valueAt := func(id int64) interface{} {
+		t.Helper()
+		records, err := tm.Select(table).AsOf(time.Unix(0, id)).GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		return records[0].FieldsData["n"]
+	}
+	if v := valueAt(first.ID - 1); v != nil {
+		t.Fatalf("row has n = %v before it was inserted", v)
+	}
+	if v := valueAt(first.ID); v != int64(1) {
+		t.Fatalf("row has n = %v after the insert, want 1", v)
+	}
+	if v := valueAt(history[2].ID - 1); v != int64(2) {
+		t.Fatalf("row has n = %v after the update, want 2", v)
+	}
+	if v := valueAt(history[2].ID); v != nil {
+		t.Fatalf("row has n = %v after it was deleted", v)
+	}
+
+	// The cleanup keeps replaced versions within the retention window
+	if err := tm.SetHistoryRetention(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewCleanupWorker(db, time.Hour).cleanupTable("test", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if v := valueAt(first.ID); v != int64(1) {
+		t.Fatalf("row has n = %v after the insert once the table was cleaned up, want 1", v)
+	}
+	if err := compactTestTable(t, db, table); err != nil {
+		t.Fatal(err)
+	}
+	if v := valueAt(first.ID); v != nil {
+		t.Fatalf("version outside of the retention window is still read: n = %v", v)
+	}
+}
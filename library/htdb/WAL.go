@@ -0,0 +1,242 @@
+// WAL.go
+// Description: Write-ahead log for the HTDB library
+// Commits are written to the log and synced before any table file is touched,
+// so a crash in the middle of a commit can be repaired when the database is opened again
+// Author: harto.dev
+
+package htdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const walFileName = "wal" + fileEnding
+
+// walFrameHeaderSize is the size of the header in front of every log entry
+const walFrameHeaderSize = 8 // 4 bytes payload length, 4 bytes CRC32 of the payload
+
+// walTable is the part of a committed transaction that belongs to one table
+type walTable struct {
+	Schema        string   `json:"schema"`
+	Table         string   `json:"table"`
+	Records       [][]byte `json:"records"`       // Serialized staged records
+	StartPosition int64    `json:"startPosition"` // Position in the table file the records are appended at
+}
+
+// walEntry is a committed transaction in the log
+type walEntry struct {
+	TransactionID uint64     `json:"transactionId"`
+	Tables        []walTable `json:"tables"`
+}
+
+// walEntryKept is returned by Append if a failed entry could not be cut off the log again
+// The entry might be replayed when the database is opened the next time
+type walEntryKept struct {
+	error
+}
+
+// writeAheadLog is the database wide log file under the main path
+type writeAheadLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// newWriteAheadLog creates the log for a database, the file is created on the first append
+func newWriteAheadLog(mainPath string) *writeAheadLog {
+	return &writeAheadLog{
+		path: filepath.Join(mainPath, walFileName),
+	}
+}
+
+// Append writes an entry to the log and syncs it to disk
+// An entry that fails is cut off again, so it is not replayed when the database is opened
+func (w *writeAheadLog) Append(entry walEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize log entry: %v", err)
+	}
+
+	frame := make([]byte, walFrameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[walFrameHeaderSize:], payload)
+
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %v", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read write-ahead log: %v", err)
+	}
+
+	_, err = file.Write(frame)
+	if err != nil {
+		err = fmt.Errorf("failed to write to write-ahead log: %v", err)
+	} else if err = file.Sync(); err != nil {
+		err = fmt.Errorf("failed to sync write-ahead log: %v", err)
+	}
+	if err != nil {
+		if file.Truncate(stat.Size()) != nil || file.Sync() != nil {
+			return walEntryKept{err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Entries reads all complete entries from the log
+// A torn or corrupt entry at the end is an incomplete commit and everything from there on is ignored
+func (w *writeAheadLog) Entries() ([]walEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := os.ReadFile(w.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write-ahead log: %v", err)
+	}
+
+	var entries []walEntry
+	offset := 0
+	for offset+walFrameHeaderSize <= len(data) {
+		length := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
+		checksum := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+		start := offset + walFrameHeaderSize
+
+		if start+length > len(data) || crc32.ChecksumIEEE(data[start:start+length]) != checksum {
+			break
+		}
+
+		var entry walEntry
+		if err := json.Unmarshal(data[start:start+length], &entry); err != nil {
+			break
+		}
+
+		entries = append(entries, entry)
+		offset = start + length
+	}
+
+	return entries, nil
+}
+
+// Truncate empties the log, this is done once every logged commit has been applied
+func (w *writeAheadLog) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := os.Truncate(w.path, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to truncate write-ahead log: %v", err)
+	}
+
+	file, err := os.OpenFile(w.path, os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %v", err)
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// recoverWAL replays every complete commit in the log and discards incomplete ones
+func (db *HTDB) recoverWAL() error {
+	entries, err := db.wal.Entries()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		for _, wt := range entry.Tables {
+			table, err := GetTable(wt.Schema+":"+wt.Table, db.mainPath)
+			if err != nil {
+				return fmt.Errorf("failed to replay transaction %d: %v", entry.TransactionID, err)
+			}
+
+			// The version map might not know about the replayed records
+			db.GetTableManager().dropVersions(table)
+
+			err = db.applyWALTable(table, wt)
+			if err != nil {
+				return fmt.Errorf("failed to replay transaction %d: %v", entry.TransactionID, err)
+			}
+		}
+	}
+
+	return db.wal.Truncate()
+}
+
+// applyWALTable appends the logged records of one table to the table file and its indexes
+// The records always go to the logged position, so a commit can safely be replayed
+func (db *HTDB) applyWALTable(table *Table, wt walTable) error {
+	var data []byte
+	var records []*Record
+	var positions []int64
+	for i, recordData := range wt.Records {
+		record, err := deserializeRecord(recordData, table.Fields, table.FormatVersion)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize logged record: %v", err)
+		}
+
+		data = append(data, recordData...)
+		records = append(records, record)
+		positions = append(positions, wt.StartPosition+int64(i))
+	}
+
+	err := table.appendRecords(wt.StartPosition, data)
+	if err != nil {
+		return fmt.Errorf("failed to write records to table '%s': %v", table.TableName, err)
+	}
+
+	tm := db.GetTableManager()
+	tm.addVersions(table, records, positions)
+
+	err = tm.indexRecords(table, records, positions)
+	if err != nil {
+		return fmt.Errorf("failed to update indexes of table '%s': %v", table.TableName, err)
+	}
+
+	return nil
+}
+
+// syncDir syncs a directory so renames and new files in it are durable
+// Not every platform can sync directories, so errors are ignored
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	dir.Sync()
+}
+
+// syncFile syncs a file that was written through another handle
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
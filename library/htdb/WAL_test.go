@@ -0,0 +1,137 @@
+package htdb
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWALReplayBeforeFormatUpgrade replays a commit that was logged for a table in the version 4 format
+// The logged record points into a ref file without header bytes, the upgrade has to move it with the stored records
+func TestWALReplayBeforeFormatUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := createTestTable(t, db, "notes", []Field{{Name: "n", Type: Int, Length: 8}, {Name: "text", Type: "ref", Length: 128}})
+	if _, err := db.GetTableManager().InsertRecord(table, map[string]interface{}{"n": 1, "text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Turn the table back into version 4: no header bytes in the ref file and the commit only in the log
+	table, err = GetTable("test:notes", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := table.GetAllRecords()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected one record, got %d (%v)", len(records), err)
+	}
+	records[0].RefOffsets["text"] = [2]int64{0, 5}
+	recordData, err := records[0].Serialize(table.Fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(table.refPath("text"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(table.dataPath(), 0); err != nil {
+		t.Fatal(err)
+	}
+	table.FormatVersion = 4
+	if err := table.saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := walEntry{TransactionID: 1, Tables: []walTable{{Schema: "test", Table: "notes", Records: [][]byte{recordData}}}}
+	if err := newWriteAheadLog(dir).Append(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, dir)
+	table, err = db.GetTableManager().GetTable("test", "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.FormatVersion != tableFormatVersion {
+		t.Fatalf("table was not upgraded, format version %d", table.FormatVersion)
+	}
+
+	record, err := db.GetTableManager().Select(table).Where("n", "=", 1).First()
+	if err != nil {
+		t.Fatalf("logged record was not replayed: %v", err)
+	}
+	text, err := record.ReadRefData(table.SchemaPath, table.TableName, "text")
+	if err != nil || text != "hello" {
+		t.Fatalf("expected 'hello', got %q (%v)", text, err)
+	}
+}
+
+func TestFailedLogAppendTakesBackReferenceCounts(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "data", Type: Blob, Dedup: true}})
+	if _, err := tm.InsertRecord(table, map[string]interface{}{"data": []byte("value")}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := tm.BeginTransaction()
+	if _, err := tx.StageInsert(table, map[string]interface{}{"data": []byte("value")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in place of the log makes the append fail
+	walPath := filepath.Join(dir, walFileName)
+	os.Remove(walPath)
+	if err := os.Mkdir(walPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("commit succeeded without the log")
+	}
+	hash := sha256.Sum256([]byte("value"))
+	if count := refCounts(t, table, "data")[hash]; count != 1 {
+		t.Fatalf("value is counted %d times after the failed commit, want 1", count)
+	}
+
+	// The transaction is still active and counts once when it is committed
+	if err := os.Remove(walPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if count := refCounts(t, table, "data")[hash]; count != 2 {
+		t.Fatalf("value is counted %d times after the commit, want 2", count)
+	}
+}
+
+func TestOpenFailsWhenTheLogCannotBeReplayed(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	db.Close()
+
+	// The logged commit continues the table file behind its end
+	entry := walEntry{TransactionID: 1, Tables: []walTable{{Schema: "test", Table: "a", StartPosition: 10}}}
+	if err := newWriteAheadLog(dir).Append(entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, Options{}); err == nil {
+		t.Fatal("database was opened with a commit that could not be replayed")
+	}
+
+	// The failed open released the database
+	if err := newWriteAheadLog(dir).Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	openTestDB(t, dir)
+}
@@ -8,10 +8,31 @@
 // didnt do the last step about the responses
 package htdb
 
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type HTDB struct {
 	mainPath      string
 	lastTimestamp int64
 	tableManager  *TableManager
+	wal           *writeAheadLog
+	walDirty      bool       // true if a logged commit could not be applied yet
+	commitMu      sync.Mutex // Commits are applied one after another
+	lastCommit    int64      // Highest version ID of the commits that are applied, transactions read up to it
+	readOnly      bool       // Opened with Options.ReadOnly
+	lock          *fileLock  // Lock on the database directory
+	closed        bool       // Set by Close
+	closeMu       sync.Mutex
+	defaultSchema string // Schema of table names without a schema, empty if there is none
+	settingsMu    sync.Mutex
 }
 
 // --- Field Presets ---
@@ -36,13 +57,330 @@ var timePKField = Field{
 
 const fileEnding string = ".htdb"
 
+// formatFileName is the marker file with the format version of the database directory
+const formatFileName = "format" + fileEnding
+
+// dbFormatVersion is the layout of the database directory that this version of the library writes
+// 1: schema directories, wal.htdb and lock.htdb under the main path
+// 2: table configurations are stored in the index.conf.htdb catalog of their schema
+const dbFormatVersion = 2
+
+// databaseFormat is the content of the format marker file
+type databaseFormat struct {
+	FormatVersion int `json:"formatVersion"`
+}
+
+// Options configure how a database is opened
+type Options struct {
+	ReadOnly        bool          // Open for reading, any number of readers can open the database as long as there is no writer
+	CreateIfMissing bool          // Create the database directory if it doesn't exist yet, ignored for readers
+	CleanupInterval time.Duration // Start the cleanup worker with this interval, 0 doesn't start it
+	DefaultSchema   string        // Schema of table names without a schema, see ResolveTable
+}
+
 // Constructor
+// NewHTDB opens a database for reading and writing, no other process can open it at the same time
+//
+// Deprecated: NewHTDB panics if the database can't be opened, use Open to get the error
 func NewHTDB(mainPath string) *HTDB {
+	db, err := Open(mainPath, Options{CreateIfMissing: true})
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// NewReadOnlyHTDB opens a database for reading, any number of readers can open it as long as there is no writer
+func NewReadOnlyHTDB(mainPath string) (*HTDB, error) {
+	return Open(mainPath, Options{ReadOnly: true})
+}
+
+// Open opens the database in mainPath, locks the directory and brings the files up to date
+// The database has to be closed with Close when it is no longer used
+func Open(mainPath string, opts Options) (*HTDB, error) {
+	if opts.CleanupInterval < 0 {
+		return nil, NewResponse(StatusBadRequest, "Cleanup interval can't be negative")
+	}
+
+	stat, err := os.Stat(mainPath)
+	if os.IsNotExist(err) {
+		if opts.ReadOnly || !opts.CreateIfMissing {
+			return nil, NewResponse(StatusDbError, "Database "+mainPath+" does not exist")
+		}
+		err = os.MkdirAll(mainPath, 0777)
+	} else if err == nil && !stat.IsDir() {
+		err = fmt.Errorf("%s is not a directory", mainPath)
+	}
+	if err != nil {
+		return nil, NewResponse(StatusDbError, fmt.Sprint(err))
+	}
+
+	lock, err := acquireFileLock(mainPath, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
 	db := &HTDB{
-		mainPath: mainPath,
+		mainPath:      mainPath,
+		readOnly:      opts.ReadOnly,
+		lock:          lock,
+		defaultSchema: opts.DefaultSchema,
 	}
 	db.tableManager = NewTableManager(db)
-	return db
+	db.wal = newWriteAheadLog(mainPath)
+
+	err = db.checkFormat()
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+
+	if opts.ReadOnly {
+		// Readers can't repair the files, a writer has to open the database first
+		entries, err := db.wal.Entries()
+		if err == nil && len(entries) > 0 {
+			err = NewResponse(StatusDbError, "Database "+mainPath+" has commits that were interrupted by a crash, open it for writing first")
+		}
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+	} else {
+		// Schema drops and table renames that were interrupted are finished first
+		db.removeDroppedSchemas()
+		err = db.finishRenames()
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+
+		// Files of the last generation before the current one and of interrupted compactions are removed
+		err = db.removeOldGenerations()
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+
+		// Upgrades that were interrupted after the switch to the new format are finished
+		err = db.finishUpgrades()
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+
+		// Finish commits that were interrupted by a crash, the logged records are in the format of their table
+		err = db.recoverWAL()
+		if err != nil {
+			lock.release()
+			return nil, fmt.Errorf("failed to recover from the write-ahead log: %v", err)
+		}
+
+		// Tables written by older versions of the library are upgraded
+		err = db.upgradeTables()
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+
+		// Column changes that were interrupted are finished before the tables are used
+		err = db.resumeMigrations()
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+	}
+
+	// New versions get higher IDs than the committed ones, even if the clock went back since they were written
+	err = db.seedTimestamp()
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+
+	// Everything on disk is committed
+	db.lastCommit = db.generateUniqueTimestamp()
+
+	if opts.CleanupInterval > 0 && !opts.ReadOnly {
+		err = db.tableManager.StartCleanupWorker(opts.CleanupInterval)
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// checkFormat reads the format marker of the database directory
+// Writers upgrade directories of older versions of the library, directories without a marker are new or from before version 1
+func (db *HTDB) checkFormat() error {
+	path := filepath.Join(db.mainPath, formatFileName)
+
+	var format databaseFormat
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return NewResponse(StatusDbError, fmt.Sprint(err))
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &format)
+		if err != nil {
+			return NewResponse(StatusDbError, "Database "+db.mainPath+" has an invalid format marker: "+err.Error())
+		}
+	}
+
+	if format.FormatVersion > dbFormatVersion {
+		return NewResponse(StatusDbError, fmt.Sprintf("Database %s has format version %d, this version of the library supports up to %d", db.mainPath, format.FormatVersion, dbFormatVersion))
+	}
+
+	if format.FormatVersion == dbFormatVersion {
+		return nil
+	}
+
+	// Readers can't upgrade the directory, a writer has to open the database first
+	if db.readOnly {
+		return NewResponse(StatusDbError, "Database "+db.mainPath+" was written by an older version of the library, open it for writing first")
+	}
+
+	// Table configurations move into the schema catalogs
+	err = db.upgradeCatalogs()
+	if err != nil {
+		return err
+	}
+
+	return writeFormatFile(path)
+}
+
+// writeFormatFile writes the format marker with the current format version
+func writeFormatFile(path string) error {
+	data, err := json.Marshal(databaseFormat{FormatVersion: dbFormatVersion})
+	if err != nil {
+		return NewResponse(StatusInternalError, fmt.Sprint(err))
+	}
+
+	err = os.WriteFile(path+".temp", data, 0644)
+	if err == nil {
+		err = syncFile(path + ".temp")
+	}
+	if err == nil {
+		err = os.Rename(path+".temp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".temp")
+		return NewResponse(StatusDbError, fmt.Sprint(err))
+	}
+	syncDir(filepath.Dir(path))
+
+	return nil
+}
+
+// Close stops the cleanup worker, rolls back the transactions that are still active, waits for running migrations,
+// flushes the open indexes and releases the lock on the database directory
+func (db *HTDB) Close() error {
+	// New writes fail from here on
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return NewResponse(StatusDatabaseClosed, "Database "+db.mainPath+" is already closed")
+	}
+	db.closed = true
+	db.closeMu.Unlock()
+
+	var firstErr error
+	tm := db.tableManager
+
+	if tm.cleanupWorker != nil {
+		if err := tm.StopCleanupWorker(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// Rollbacks wait for commits that are still running, they happen outside of the transaction list mutex
+	tm.transactionsMu.Lock()
+	var active []*Transaction
+	for _, tx := range tm.transactions {
+		active = append(active, tx)
+	}
+	tm.transactionsMu.Unlock()
+
+	for _, tx := range active {
+		tx.Rollback()
+		tm.removeTransaction(tx)
+	}
+
+	// Migrations wait for the rolled back transactions, they are finished before the lock is released
+	tm.waitForMigrations()
+
+	tm.indexesMu.Lock()
+	for path, index := range tm.indexes {
+		if err := index.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := index.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(tm.indexes, path)
+	}
+	tm.indexesMu.Unlock()
+
+	if err := db.lock.release(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
+
+// IsClosed checks if the database was closed
+func (db *HTDB) IsClosed() bool {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+
+	return db.closed
+}
+
+// IsReadOnly checks if the database was opened for reading only
+func (db *HTDB) IsReadOnly() bool {
+	return db.readOnly
+}
+
+// checkWritable returns an error if the database was opened for reading only or is closed
+func (db *HTDB) checkWritable() error {
+	if db.IsClosed() {
+		return NewResponse(StatusDatabaseClosed, "Database "+db.mainPath+" is closed")
+	}
+	if db.readOnly {
+		return NewResponse(StatusReadOnly, "Database "+db.mainPath+" is opened read-only")
+	}
+	return nil
+}
+
+// DefaultSchema returns the schema of table names without a schema, empty if there is none
+func (db *HTDB) DefaultSchema() string {
+	db.settingsMu.Lock()
+	defer db.settingsMu.Unlock()
+
+	return db.defaultSchema
+}
+
+// SetDefaultSchema sets the schema of table names without a schema, an empty name removes the default
+func (db *HTDB) SetDefaultSchema(name string) {
+	db.settingsMu.Lock()
+	defer db.settingsMu.Unlock()
+
+	db.defaultSchema = name
+}
+
+// ResolveTable returns the identity of a table name in the schema:table form
+// Names without a schema belong to the default schema of the database
+func (db *HTDB) ResolveTable(name string) (TableID, error) {
+	if strings.Contains(name, ":") {
+		return ParseTableID(name)
+	}
+
+	schema := db.DefaultSchema()
+	if schema == "" {
+		return TableID{}, NewResponse(StatusBadRequest, "Table name "+name+" has no schema and the database has no default schema")
+	}
+	return TableID{Schema: schema, Table: name}, nil
 }
 
 func (db *HTDB) GetMainPath() string {
@@ -54,11 +392,78 @@ func (db *HTDB) SetMainPath(path string) {
 }
 
 func (db *HTDB) GetLastTimestamp() int64 {
-	return db.lastTimestamp
+	return atomic.LoadInt64(&db.lastTimestamp)
 }
 
 func (db *HTDB) SetLastTimestamp(timestamp int64) {
-	db.lastTimestamp = timestamp
+	atomic.StoreInt64(&db.lastTimestamp, timestamp)
+}
+
+// seedTimestamp raises the last timestamp to the highest version ID in the table files and the write-ahead log
+func (db *HTDB) seedTimestamp() error {
+	var highest int64
+	err := db.forEachTable(func(table *Table) error {
+		id, err := table.lastVersionID()
+		if err != nil {
+			return fmt.Errorf("failed to read table '%s': %v", table.TableName, err)
+		}
+		if id > highest {
+			highest = id
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Commits that could not be applied yet are only in the log
+	entries, err := db.wal.Entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		for _, wt := range entry.Tables {
+			table, err := GetTable(wt.Schema+":"+wt.Table, db.mainPath)
+			if err != nil {
+				return fmt.Errorf("failed to read transaction %d: %v", entry.TransactionID, err)
+			}
+			for _, recordData := range wt.Records {
+				record, err := deserializeRecord(recordData, table.Fields, table.FormatVersion)
+				if err != nil {
+					return fmt.Errorf("failed to deserialize logged record: %v", err)
+				}
+				if record.ID > highest {
+					highest = record.ID
+				}
+			}
+		}
+	}
+
+	if highest > db.GetLastTimestamp() {
+		db.SetLastTimestamp(highest)
+	}
+	return nil
+}
+
+// generateUniqueTimestamp returns a nanosecond timestamp that is larger than every timestamp returned before
+// Record versions get their ID from it, so IDs are in commit order
+func (db *HTDB) generateUniqueTimestamp() int64 {
+	for {
+		newTimestamp := time.Now().UnixNano()
+		current := atomic.LoadInt64(&db.lastTimestamp)
+
+		// If the new timestamp is greater, attempt to update
+		if newTimestamp > current {
+			if atomic.CompareAndSwapInt64(&db.lastTimestamp, current, newTimestamp) {
+				return newTimestamp
+			}
+		} else {
+			// Increment the current timestamp to ensure uniqueness
+			if atomic.CompareAndSwapInt64(&db.lastTimestamp, current, current+1) {
+				return current + 1
+			}
+		}
+	}
 }
 
 func (db *HTDB) GetTableManager() *TableManager {
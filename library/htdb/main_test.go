@@ -0,0 +1,45 @@
+package htdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCloseEndsTheDatabaseLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Open(filepath.Join(dir, "missing"), Options{}); err == nil {
+		t.Fatal("a missing database was opened without CreateIfMissing")
+	}
+
+	db, err := Open(dir, Options{CreateIfMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := db.GetTableManager()
+	table := createTestTable(t, db, "a", []Field{{Name: "n", Type: Int, Length: 8}})
+	tx := tm.BeginTransaction()
+	if _, err := tx.StageInsert(table, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Open transactions are rolled back, everything else fails once the database is closed
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !tx.done() {
+		t.Fatal("an open transaction was not rolled back by Close")
+	}
+	_, err = tm.InsertRecord(table, map[string]interface{}{"n": 2})
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusDatabaseClosed {
+		t.Fatalf("expected StatusDatabaseClosed for an insert, got %v", err)
+	}
+	err = db.Close()
+	if response, ok := err.(Response); !ok || response.StatusCode != StatusDatabaseClosed {
+		t.Fatalf("expected StatusDatabaseClosed for a second Close, got %v", err)
+	}
+
+	db = openTestDB(t, dir)
+	if count, err := db.GetTableManager().Select(table).Count(); err != nil || count != 0 {
+		t.Fatalf("table has %d records (%v) after the rolled back insert", count, err)
+	}
+}
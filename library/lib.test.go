@@ -10,7 +10,12 @@ func main() {
 	fmt.Println("Starting HTDB library test")
 
 	// Initialize the database
-	db := htdb.NewHTDB("./hartoDB")
+	db, err := htdb.Open("./hartoDB", htdb.Options{CreateIfMissing: true})
+	if err != nil {
+		fmt.Println("Error opening database:", err)
+		return
+	}
+	defer db.Close()
 
 	// Create a schema
 	schema, err := db.CreateSchema("testSchema")
@@ -118,6 +123,35 @@ func main() {
 		fmt.Println()
 	}
 
+	// Query records
+	fmt.Println("\n=== Querying records ===")
+	err = db.GetTableManager().CreateIndex(table, "age")
+	if err != nil {
+		fmt.Println("Error creating index:", err)
+		return
+	}
+	fmt.Println("Index on age created successfully")
+
+	topScorers, err := db.GetTableManager().Select(table).
+		Where("age", ">=", 30).
+		Sort("score", false).
+		Limit(5).
+		GetAll()
+	if err != nil {
+		fmt.Println("Error querying records:", err)
+		return
+	}
+	for _, record := range topScorers {
+		fmt.Printf("  %s (%d)\n", record.FieldsData["name"], record.FieldsData["age"])
+	}
+
+	count, err := db.GetTableManager().Select(table).Where("name", "!=", "Bob").Count()
+	if err != nil {
+		fmt.Println("Error counting records:", err)
+		return
+	}
+	fmt.Printf("Records not named Bob: %d\n", count)
+
 	// Update a record
 	if len(allRecords) > 0 {
 		fmt.Println("\n=== Updating a record ===")
@@ -142,30 +176,25 @@ func main() {
 			return
 		}
 
-		fmt.Printf("Record with ID %d updated successfully\n", updatedRecord.ID)
+		fmt.Printf("Record with ID %d updated successfully\n", updatedRecord.RowKey)
 
-		// Verify the update
-		updatedRecords, err := db.GetTableManager().GetCurrentRecords(table)
+		// Verify the update, the row keeps its ID across versions
+		record, err := db.GetTableManager().GetRecordByID(table, recordToUpdate.RowKey)
 		if err != nil {
-			fmt.Println("Error reading updated records:", err)
+			fmt.Println("Error reading updated record:", err)
 			return
 		}
 
-		for _, record := range updatedRecords {
-			if record.ID == updatedRecord.ID {
-				fmt.Println("Updated record:")
-				fmt.Printf("  ID: %d\n", record.ID)
-				fmt.Printf("  Name: %s\n", record.FieldsData["name"])
-				fmt.Printf("  Score: %.1f\n", record.FieldsData["score"])
-
-				description, err := record.ReadRefData(table.SchemaPath, table.TableName, "description")
-				if err != nil {
-					fmt.Printf("  Error reading description: %v\n", err)
-				} else {
-					fmt.Printf("  Description: %s\n", description)
-				}
-				break
-			}
+		fmt.Println("Updated record:")
+		fmt.Printf("  ID: %d\n", record.RowKey)
+		fmt.Printf("  Name: %s\n", record.FieldsData["name"])
+		fmt.Printf("  Score: %.1f\n", record.FieldsData["score"])
+
+		description, err := record.ReadRefData(table.SchemaPath, table.TableName, "description")
+		if err != nil {
+			fmt.Printf("  Error reading description: %v\n", err)
+		} else {
+			fmt.Printf("  Description: %s\n", description)
 		}
 	}
 
@@ -180,7 +209,7 @@ func main() {
 			return
 		}
 
-		fmt.Printf("Record with ID %d deleted successfully\n", recordToDelete.ID)
+		fmt.Printf("Record with ID %d deleted successfully\n", recordToDelete.RowKey)
 
 		// Verify the delete
 		remainingRecords, err := db.GetTableManager().GetCurrentRecords(table)
@@ -192,6 +221,26 @@ func main() {
 		fmt.Printf("Remaining records: %d\n", len(remainingRecords))
 	}
 
+	// Look at the history of the table
+	if len(allRecords) > 0 {
+		fmt.Println("\n=== History ===")
+		history, err := db.GetTableManager().History(table, allRecords[0].RowKey)
+		if err != nil {
+			fmt.Println("Error reading history:", err)
+			return
+		}
+		for _, version := range history {
+			fmt.Printf("  Version %d: score %.1f\n", version.ID, version.FieldsData["score"])
+		}
+
+		before, err := db.GetTableManager().Select(table).AsOf(time.Unix(0, history[0].ID)).Count()
+		if err != nil {
+			fmt.Println("Error querying the past:", err)
+			return
+		}
+		fmt.Printf("Records when the first version was committed: %d\n", before)
+	}
+
 	// Start the cleanup worker
 	fmt.Println("\n=== Starting cleanup worker ===")
 	err = db.GetTableManager().StartCleanupWorker(1 * time.Minute)
@@ -59,7 +59,12 @@ const fileEnding string = ".htdb"
 
 func main() {
 
-	db := htdb.NewHTDB(mainPath)
+	db, err := htdb.Open(mainPath, htdb.Options{CreateIfMissing: true})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer db.Close()
 	fmt.Println(db)
 
 	fmt.Println(createDatabase("testDB1"))
@@ -243,6 +248,13 @@ func createTable(name string, schema string, fields []field) response {
 		return response{time.Now().String(), 406, "Can't name a Table \"index\", sowwy"}
 	}
 
+	// Bool fields take one byte unless a length is given
+	for i := range fields {
+		if fields[i].Type == "bool" && fields[i].Length == 0 {
+			fields[i].Length = 1
+		}
+	}
+
 	// Validate field lengths
 	if err := validateFieldLengths(fields); err != nil {
 		return response{time.Now().String(), 406, err.Error()}
@@ -305,6 +317,9 @@ func validateFieldLengths(fields []field) error {
 		if f.Type == "timeID" && f.Length != 8 {
 			return fmt.Errorf("field '%s' of type 'timeID' must have a length of 8 bytes", f.Name)
 		}
+		if f.Type == "bool" && f.Length != 1 {
+			return fmt.Errorf("field '%s' of type 'bool' must have a length of 1 byte", f.Name)
+		}
 	}
 	return nil
 }
@@ -449,6 +464,15 @@ func serializeField(field field, value interface{}) ([]byte, error) {
 			return nil, fmt.Errorf("value must be a string for field type 'ref'")
 		}
 		return stringToBytes(v, int(field.Length)), nil
+	case "bool":
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("value must be a bool for field type 'bool'")
+		}
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
 	default:
 		return nil, fmt.Errorf("unsupported field type '%s'", field.Type)
 	}
@@ -588,6 +612,8 @@ func deserializeField(field field, data []byte) interface{} {
 		return bytesToFloat64(data)
 	case "string", "ref":
 		return strings.TrimRight(string(data), "\x00") // Trim null bytes
+	case "bool":
+		return len(data) > 0 && data[0] != 0
 	default:
 		return nil
 	}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestBoolFieldRoundTrip(t *testing.T) {
+	f := field{Name: "active", Type: "bool", Length: 1}
+	for _, value := range []bool{true, false} {
+		data, err := serializeField(f, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 1 {
+			t.Fatalf("bool value takes %d bytes, want 1", len(data))
+		}
+		if got := deserializeField(f, data); got != value {
+			t.Fatalf("expected %v, got %v", value, got)
+		}
+	}
+
+	if _, err := serializeField(f, 1); err == nil {
+		t.Fatal("an int was stored in a bool field")
+	}
+	if err := validateFieldLengths([]field{{Name: "active", Type: "bool", Length: 2}}); err == nil {
+		t.Fatal("a bool field with a length of 2 bytes was accepted")
+	}
+}